@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sources of detected ad breaks
+const (
+	AdSourceDateRange     = "SCTE-35 date range"
+	AdSourceCue           = "CUE-OUT/CUE-IN"
+	AdSourceDiscontinuity = "discontinuity heuristic"
+)
+
+// AdBreak is an ad break found in a media playlist
+type AdBreak struct {
+	Start    float64 // Seconds from the start of the playlist
+	End      float64
+	First    int64 // Media sequence number of the first ad segment
+	Last     int64 // Media sequence number of the last ad segment
+	Segments int
+	Source   string
+	ID       string // Date range ID, if any
+}
+
+// parseCueDuration parses the duration of an #EXT-X-CUE-OUT tag, given as
+// "#EXT-X-CUE-OUT:30" or "#EXT-X-CUE-OUT:DURATION=30"
+func parseCueDuration(line string) float64 {
+	colon := strings.Index(line, ":")
+	if colon == -1 {
+		return 0
+	}
+	value := line[colon+1:]
+	if duration, ok := parseAttributes(line)["DURATION"]; ok {
+		value = duration
+	}
+	duration, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return duration
+}
+
+// Whether runs of segments between discontinuities are guessed to be ads
+var adHeuristic bool
+
+// SetAdHeuristic enables the discontinuity heuristic of DetectAdBreaks
+func SetAdHeuristic(enabled bool) {
+	adHeuristic = enabled
+}
+
+// DetectAdBreaks finds the ad breaks of a media playlist. SCTE-35 date ranges
+// and cue tags are used if the playlist has them; otherwise, with the
+// heuristic enabled, runs of segments between discontinuities served from a
+// different location than most of the playlist are taken to be ads.
+func DetectAdBreaks(playlist *M3U8Playlist) []AdBreak {
+	if breaks := dateRangeBreaks(playlist); len(breaks) > 0 {
+		return breaks
+	}
+	if breaks := cueBreaks(playlist.Segments); len(breaks) > 0 {
+		return breaks
+	}
+	if !adHeuristic {
+		return nil
+	}
+	return discontinuityBreaks(playlist.Segments)
+}
+
+// dateRangeBreaks maps SCTE35-OUT/SCTE35-IN date ranges to segments
+func dateRangeBreaks(playlist *M3U8Playlist) []AdBreak {
+	ranges := append([]DateRange(nil), playlist.DateRanges...)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].StartDate.Before(ranges[j].StartDate)
+	})
+
+	total := 0.0
+	for _, segment := range playlist.Segments {
+		total += segment.Duration
+	}
+
+	var breaks []AdBreak
+	var open *DateRange // Break whose end is not known yet
+	add := func(dateRange *DateRange, end float64) {
+		start, err := offsetAtTime(playlist.Segments, dateRange.StartDate)
+		if err != nil {
+			return
+		}
+		if adBreak, ok := breakBetween(playlist.Segments, start, end); ok {
+			adBreak.Source = AdSourceDateRange
+			adBreak.ID = dateRange.ID
+			breaks = append(breaks, adBreak)
+		}
+	}
+	for i := range ranges {
+		dateRange := &ranges[i]
+		switch {
+		case dateRange.SCTE35Out != "":
+			if open != nil {
+				if offset, err := offsetAtTime(playlist.Segments, dateRange.StartDate); err == nil {
+					add(open, offset)
+				}
+			}
+			open = nil
+			if end := dateRange.End(); !end.IsZero() {
+				if offset, err := offsetAtTime(playlist.Segments, end); err == nil {
+					add(dateRange, offset)
+					continue
+				}
+			}
+			open = dateRange
+		case dateRange.SCTE35In != "" && open != nil:
+			if offset, err := offsetAtTime(playlist.Segments, dateRange.StartDate); err == nil {
+				add(open, offset)
+			}
+			open = nil
+		}
+	}
+	if open != nil {
+		add(open, total)
+	}
+	return breaks
+}
+
+// cueBreaks finds breaks marked with #EXT-X-CUE-OUT, #EXT-X-CUE-OUT-CONT and
+// #EXT-X-CUE-IN. A break without CUE-IN ends after its announced duration.
+func cueBreaks(segments []Segment) []AdBreak {
+	var breaks []AdBreak
+	var current *AdBreak
+	remaining := 0.0
+	position := 0.0
+	for _, segment := range segments {
+		if current != nil && (segment.Cue == CueIn || segment.Cue == CueOut) {
+			breaks = append(breaks, *current)
+			current = nil
+		}
+		if current == nil && (segment.Cue == CueOut || segment.Cue == CueCont) {
+			current = &AdBreak{Start: position, First: segment.Sequence, Source: AdSourceCue}
+			remaining = segment.CueDuration
+		}
+
+		if current != nil {
+			current.End = position + segment.Duration
+			current.Last = segment.Sequence
+			current.Segments++
+			if remaining > 0 {
+				remaining -= segment.Duration
+				if remaining <= 0.001 {
+					breaks = append(breaks, *current)
+					current = nil
+				}
+			}
+		}
+		position += segment.Duration
+	}
+	if current != nil {
+		breaks = append(breaks, *current)
+	}
+	return breaks
+}
+
+// discontinuityBreaks finds runs of segments between discontinuities that are
+// served from a different host or directory than most of the playlist
+func discontinuityBreaks(segments []Segment) []AdBreak {
+	type run struct {
+		first, last int
+		location    string
+	}
+	var runs []run
+	byLocation := make(map[string]float64)
+	for i, segment := range segments {
+		location := segmentLocation(segment.URL)
+		if i == 0 || segment.Discontinuity {
+			runs = append(runs, run{first: i, location: location})
+		}
+		runs[len(runs)-1].last = i
+		byLocation[location] += segment.Duration
+	}
+	if len(runs) < 2 {
+		return nil
+	}
+
+	// Content is wherever most of the playlist comes from
+	content := ""
+	for location, duration := range byLocation {
+		if content == "" || duration > byLocation[content] || (duration == byLocation[content] && location < content) {
+			content = location
+		}
+	}
+
+	var breaks []AdBreak
+	position := 0.0
+	index := 0
+	for _, r := range runs {
+		for ; index < r.first; index++ {
+			position += segments[index].Duration
+		}
+		if r.location == content {
+			continue
+		}
+		adBreak := AdBreak{Start: position, End: position, First: segments[r.first].Sequence, Last: segments[r.last].Sequence, Source: AdSourceDiscontinuity}
+		for i := r.first; i <= r.last; i++ {
+			adBreak.End += segments[i].Duration
+			adBreak.Segments++
+		}
+		breaks = append(breaks, adBreak)
+	}
+	return breaks
+}
+
+// segmentLocation returns the host and directory of a segment URL
+func segmentLocation(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Host + path.Dir(parsed.Path)
+}
+
+// breakBetween returns the break covering the segments whose midpoint lies
+// between start and end seconds
+func breakBetween(segments []Segment, start, end float64) (AdBreak, bool) {
+	adBreak := AdBreak{}
+	position := 0.0
+	for _, segment := range segments {
+		middle := position + segment.Duration/2
+		if middle >= start && middle < end {
+			if adBreak.Segments == 0 {
+				adBreak.Start = position
+				adBreak.First = segment.Sequence
+			}
+			adBreak.End = position + segment.Duration
+			adBreak.Last = segment.Sequence
+			adBreak.Segments++
+		}
+		position += segment.Duration
+	}
+	return adBreak, adBreak.Segments > 0
+}
+
+// adSequences returns the media sequence numbers of the segments in breaks
+func adSequences(breaks []AdBreak) map[int64]bool {
+	sequences := make(map[int64]bool)
+	for _, adBreak := range breaks {
+		for sequence := adBreak.First; sequence <= adBreak.Last; sequence++ {
+			sequences[sequence] = true
+		}
+	}
+	return sequences
+}
+
+// SkipAdBreaks removes the ad segments of a playlist and its separate audio
+// track before they are downloaded. Audio segments are removed if their
+// midpoint falls inside a break. It returns the number of video segments
+// removed.
+func SkipAdBreaks(playlist *M3U8Playlist, breaks []AdBreak) int {
+	ads := adSequences(breaks)
+	var kept []Segment
+	for _, segment := range playlist.Segments {
+		if !ads[segment.Sequence] {
+			kept = append(kept, segment)
+		}
+	}
+	removed := len(playlist.Segments) - len(kept)
+	playlist.Segments = kept
+
+	if playlist.AudioPlaylist != nil {
+		playlist.AudioPlaylist.Segments = withoutBreaks(playlist.AudioPlaylist.Segments, breaks)
+		playlist.AudioSegments = playlist.AudioPlaylist.Segments
+	} else if len(playlist.AudioSegments) > 0 {
+		playlist.AudioSegments = withoutBreaks(playlist.AudioSegments, breaks)
+	}
+	return removed
+}
+
+// withoutBreaks returns the segments whose midpoint is outside every break
+func withoutBreaks(segments []Segment, breaks []AdBreak) []Segment {
+	var kept []Segment
+	position := 0.0
+	for _, segment := range segments {
+		middle := position + segment.Duration/2
+		inBreak := false
+		for _, adBreak := range breaks {
+			if middle >= adBreak.Start && middle < adBreak.End {
+				inBreak = true
+				break
+			}
+		}
+		if !inBreak {
+			kept = append(kept, segment)
+		}
+		position += segment.Duration
+	}
+	return kept
+}
+
+// WriteAdBreaks writes one line per ad break with its time range in the
+// playlist, the segments it covers, whether it was kept and how it was found.
+// Removed breaks also give the point of the output where they were cut.
+func WriteAdBreaks(path string, breaks []AdBreak, skipped bool) error {
+	var b strings.Builder
+	total := 0.0
+	removed := 0.0
+	for i, adBreak := range breaks {
+		output := "kept"
+		if skipped {
+			output = "removed at " + formatTimestamp(adBreak.Start-removed)
+			removed += adBreak.End - adBreak.Start
+		}
+		source := adBreak.Source
+		if adBreak.ID != "" {
+			source += " " + adBreak.ID
+		}
+		fmt.Fprintf(&b, "%s - %s\tad break %d\tsegments %d-%d\t%s\t%s\n",
+			formatTimestamp(adBreak.Start), formatTimestamp(adBreak.End), i+1, adBreak.First, adBreak.Last, output, source)
+		total += adBreak.End - adBreak.Start
+	}
+	fmt.Fprintf(&b, "# %d ad break(s), %.3f seconds\n", len(breaks), total)
+
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write ad break list: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sources of chapter markers, in order of precedence when two markers fall
+// on the same point
+const (
+	ChapterDateRange     = "daterange"
+	ChapterID3           = "id3"
+	ChapterAd            = "ad"
+	ChapterDiscontinuity = "discontinuity"
+	ChapterStart         = "start" // Start of the output, before the first marker
+)
+
+// chapterPrecedence ranks marker sources; lower wins
+var chapterPrecedence = map[string]int{
+	ChapterDateRange:     0,
+	ChapterID3:           1,
+	ChapterAd:            2,
+	ChapterDiscontinuity: 3,
+}
+
+// chapterMergeWindow is how close two markers have to be, in seconds, to
+// be treated as the same point
+const chapterMergeWindow = 0.5
+
+// Chapter is a titled span of the output
+type Chapter struct {
+	Start  float64 `json:"start"` // Seconds from the start of the output
+	End    float64 `json:"end"`
+	Title  string  `json:"title"`
+	Source string  `json:"source"`
+}
+
+// chapterMarker is a point where a chapter starts
+type chapterMarker struct {
+	At     float64
+	Title  string
+	Source string
+}
+
+// BuildChapters turns the date ranges, ad breaks and discontinuities of a
+// playlist, and the ID3 cues of its downloaded segments, into chapters
+// covering the whole playlist
+func BuildChapters(playlist *M3U8Playlist, breaks []AdBreak, cues []ID3Cue) []Chapter {
+	total := 0.0
+	for _, segment := range playlist.Segments {
+		total += segment.Duration
+	}
+
+	var markers []chapterMarker
+	for _, dateRange := range playlist.DateRanges {
+		// SCTE-35 date ranges are covered by the ad breaks
+		if dateRange.SCTE35Out != "" || dateRange.SCTE35In != "" || dateRange.StartDate.IsZero() {
+			continue
+		}
+		at, err := offsetAtTime(playlist.Segments, dateRange.StartDate)
+		if err != nil {
+			continue
+		}
+		markers = append(markers, chapterMarker{At: at, Title: dateRangeTitle(dateRange), Source: ChapterDateRange})
+	}
+	for _, cue := range cues {
+		if title := cue.Title(); title != "" {
+			markers = append(markers, chapterMarker{At: cue.Offset, Title: title, Source: ChapterID3})
+		}
+	}
+	for i, adBreak := range breaks {
+		markers = append(markers,
+			chapterMarker{At: adBreak.Start, Title: fmt.Sprintf("Ad break %d", i+1), Source: ChapterAd},
+			chapterMarker{At: adBreak.End, Source: ChapterAd})
+	}
+	position := 0.0
+	for i, segment := range playlist.Segments {
+		if segment.Discontinuity && i > 0 {
+			markers = append(markers, chapterMarker{At: position, Source: ChapterDiscontinuity})
+		}
+		position += segment.Duration
+	}
+
+	return chaptersFromMarkers(markers, total)
+}
+
+// dateRangeTitle picks a chapter title for a date range: its X-TITLE client
+// attribute, its CLASS or its ID
+func dateRangeTitle(dateRange DateRange) string {
+	for _, name := range []string{"X-TITLE", "X-COM-APPLE-HLS-TITLE", "X-PROGRAM"} {
+		if title := dateRange.ClientAttrs[name]; title != "" {
+			return title
+		}
+	}
+	if dateRange.Class != "" {
+		return dateRange.Class + " " + dateRange.ID
+	}
+	return dateRange.ID
+}
+
+// chaptersFromMarkers sorts markers, merges markers on the same point and
+// turns each into a chapter ending at the next one. Untitled markers, such as
+// discontinuities and the ends of ad breaks, are numbered as parts.
+func chaptersFromMarkers(markers []chapterMarker, total float64) []Chapter {
+	sort.SliceStable(markers, func(i, j int) bool {
+		return markers[i].At < markers[j].At
+	})
+
+	var merged []chapterMarker
+	for _, marker := range markers {
+		if marker.At < 0 || marker.At >= total {
+			continue
+		}
+		if len(merged) > 0 && marker.At-merged[len(merged)-1].At < chapterMergeWindow {
+			last := &merged[len(merged)-1]
+			if last.Title == "" || (marker.Title != "" && chapterPrecedence[marker.Source] < chapterPrecedence[last.Source]) {
+				at := last.At
+				*last = marker
+				last.At = at
+			}
+			continue
+		}
+		merged = append(merged, marker)
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	if merged[0].At >= chapterMergeWindow {
+		merged = append([]chapterMarker{{At: 0, Source: ChapterStart}}, merged...)
+	} else {
+		merged[0].At = 0
+	}
+
+	chapters := make([]Chapter, len(merged))
+	part := 0
+	for i, marker := range merged {
+		end := total
+		if i+1 < len(merged) {
+			end = merged[i+1].At
+		}
+		title := marker.Title
+		if title == "" {
+			part++
+			title = fmt.Sprintf("Part %d", part)
+		}
+		chapters[i] = Chapter{Start: marker.At, End: end, Title: title, Source: marker.Source}
+	}
+	return chapters
+}
+
+// ShiftChapters moves chapters offset seconds earlier, for an output trimmed
+// at the start, dropping those that end before the output starts or start
+// after length (0 for no limit)
+func ShiftChapters(chapters []Chapter, offset, length float64) []Chapter {
+	var shifted []Chapter
+	for _, chapter := range chapters {
+		chapter.Start -= offset
+		chapter.End -= offset
+		if chapter.End <= 0 || (length > 0 && chapter.Start >= length) {
+			continue
+		}
+		chapter.Start = max(chapter.Start, 0)
+		if length > 0 {
+			chapter.End = min(chapter.End, length)
+		}
+		shifted = append(shifted, chapter)
+	}
+	return shifted
+}
+
+// WriteChapterSidecars writes the chapters as <base>.chapters.json and as a
+// WebVTT chapter track, <base>.chapters.vtt
+func WriteChapterSidecars(output string, chapters []Chapter) ([]string, error) {
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+
+	jsonPath := base + ".chapters.json"
+	data, err := json.MarshalIndent(chapters, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode chapters: %w", err)
+	}
+	if err := os.WriteFile(jsonPath, append(data, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write chapters: %w", err)
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i, chapter := range chapters {
+		fmt.Fprintf(&vtt, "\n%d\n%s --> %s\n%s\n", i+1, formatTimestamp(chapter.Start), formatTimestamp(chapter.End), chapter.Title)
+	}
+	vttPath := base + ".chapters.vtt"
+	if err := os.WriteFile(vttPath, []byte(vtt.String()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write chapters: %w", err)
+	}
+	return []string{jsonPath, vttPath}, nil
+}
+
+// EmbedChapters writes chapters into an MP4 or MKV file with ffmpeg, through
+// an FFMETADATA file
+func EmbedChapters(path string, chapters []Chapter) error {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	var metadata strings.Builder
+	metadata.WriteString(";FFMETADATA1\n")
+	for _, chapter := range chapters {
+		fmt.Fprintf(&metadata, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(chapter.Start*1000+0.5), int64(chapter.End*1000+0.5), escapeFFMetadata(chapter.Title))
+	}
+	metadataFile, err := os.CreateTemp("", "m3u8-chapters-*.txt")
+	if err != nil {
+		return fmt.Errorf("failed to create chapter metadata file: %w", err)
+	}
+	defer os.Remove(metadataFile.Name())
+	if _, err := metadataFile.WriteString(metadata.String()); err != nil {
+		metadataFile.Close()
+		return fmt.Errorf("failed to write chapter metadata file: %w", err)
+	}
+	metadataFile.Close()
+
+	ext := filepath.Ext(path)
+	withChapters := strings.TrimSuffix(path, ext) + "_chapters" + ext
+	cmd := exec.Command(ffmpegPath, "-i", path, "-i", metadataFile.Name(),
+		"-map", "0", "-map_metadata", "0", "-map_chapters", "1", "-c", "copy", "-y", withChapters)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(withChapters)
+		return fmt.Errorf("ffmpeg chapter embedding failed: %w\nOutput: %s", err, string(output))
+	}
+	if err := os.Rename(withChapters, path); err != nil {
+		return fmt.Errorf("failed to replace output with chaptered file: %w", err)
+	}
+	return nil
+}
+
+// escapeFFMetadata escapes the characters with a special meaning in
+// FFMETADATA values
+func escapeFFMetadata(value string) string {
+	replacer := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+	return replacer.Replace(value)
+}
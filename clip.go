@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trim modes for -trim
+const (
+	TrimNone  = "none"  // Keep whole segments at the edges
+	TrimCopy  = "copy"  // Cut without re-encoding, on the nearest keyframe
+	TrimExact = "exact" // Re-encode so the output starts and ends exactly on the range
+)
+
+// parseTrimMode validates a -trim value
+func parseTrimMode(value string) (string, error) {
+	switch value {
+	case TrimNone, TrimCopy, TrimExact:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid trim mode %q (expected none, copy or exact)", value)
+}
+
+// ClipPoint is a -start or -end value: an offset from the start of the
+// playlist, or a date and time matched against #EXT-X-PROGRAM-DATE-TIME
+type ClipPoint struct {
+	Offset float64   // Seconds from the start of the playlist
+	Time   time.Time // Absolute time, if set
+}
+
+// clipTimeLayouts are the accepted absolute time formats. Times without a
+// zone are local times.
+var clipTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseClipPoint parses an offset ("90", "1m30s", "01:30", "00:01:30.500")
+// or an absolute time ("2024-05-01T18:00:00Z")
+func parseClipPoint(value string) (ClipPoint, error) {
+	value = strings.TrimSpace(value)
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return ClipPoint{Offset: seconds}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return ClipPoint{Offset: duration.Seconds()}, nil
+	}
+	if seconds, ok := parseClockOffset(value); ok {
+		return ClipPoint{Offset: seconds}, nil
+	}
+	for _, layout := range clipTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return ClipPoint{Time: t}, nil
+		}
+	}
+	return ClipPoint{}, fmt.Errorf("invalid time %q (expected seconds, a duration such as 1m30s, HH:MM:SS or an RFC 3339 date and time)", value)
+}
+
+// parseClipFlag parses a -start or -end value, returning nil if it is empty
+func parseClipFlag(value string) (*ClipPoint, error) {
+	if value == "" {
+		return nil, nil
+	}
+	point, err := parseClipPoint(value)
+	if err != nil {
+		return nil, err
+	}
+	return &point, nil
+}
+
+// parseClockOffset parses [HH:]MM:SS[.fraction] into seconds
+func parseClockOffset(value string) (float64, bool) {
+	fields := strings.Split(value, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return 0, false
+	}
+	seconds := 0.0
+	for i, field := range fields {
+		n, err := strconv.ParseFloat(field, 64)
+		if err != nil || n < 0 || (i < len(fields)-1 && strings.Contains(field, ".")) {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, true
+}
+
+// parseProgramDateTime parses the value of an #EXT-X-PROGRAM-DATE-TIME tag
+func parseProgramDateTime(value string) (time.Time, error) {
+	for _, layout := range clipTimeLayouts[:2] {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid program date-time %q", value)
+}
+
+// StartPoint is the preferred point to start playback, from #EXT-X-START
+type StartPoint struct {
+	TimeOffset float64 // Seconds from the start, or from the end if negative
+	Precise    bool    // Start exactly at the offset instead of at its segment
+}
+
+// parseStartPoint parses the attributes of an #EXT-X-START tag
+func parseStartPoint(line string) (*StartPoint, error) {
+	attrs := parseAttributes(line)
+	offset, err := strconv.ParseFloat(attrs["TIME-OFFSET"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid #EXT-X-START TIME-OFFSET %q", attrs["TIME-OFFSET"])
+	}
+	return &StartPoint{TimeOffset: offset, Precise: attrs["PRECISE"] == "YES"}, nil
+}
+
+// String describes the start point for messages
+func (p *StartPoint) String() string {
+	s := fmt.Sprintf("TIME-OFFSET=%g", p.TimeOffset)
+	if p.Precise {
+		s += ",PRECISE=YES"
+	}
+	return s
+}
+
+// Offset returns the start point in seconds from the start of the segments.
+// Offsets outside the playlist are clamped to it.
+func (p *StartPoint) Offset(segments []Segment) float64 {
+	total := 0.0
+	for _, segment := range segments {
+		total += segment.Duration
+	}
+	offset := p.TimeOffset
+	if offset < 0 {
+		offset += total
+	}
+	return math.Max(0, math.Min(offset, total-segments[len(segments)-1].Duration))
+}
+
+// ClipWindow is the time range to download, in seconds from the start of the
+// playlist
+type ClipWindow struct {
+	Start float64
+	End   float64 // 0 for the end of the playlist
+}
+
+// NewClipWindow resolves -start and -end against the segments of a playlist.
+// Absolute times are matched against the program date-time of the segments.
+func NewClipWindow(start, end *ClipPoint, segments []Segment) (*ClipWindow, error) {
+	window := &ClipWindow{}
+	var err error
+	if start != nil {
+		if window.Start, err = offsetOf(*start, segments); err != nil {
+			return nil, fmt.Errorf("invalid -start: %w", err)
+		}
+	}
+	if end != nil {
+		if window.End, err = offsetOf(*end, segments); err != nil {
+			return nil, fmt.Errorf("invalid -end: %w", err)
+		}
+		if window.End <= window.Start {
+			return nil, fmt.Errorf("-end must be after -start")
+		}
+	}
+
+	total := 0.0
+	for _, segment := range segments {
+		total += segment.Duration
+	}
+	if window.Start >= total {
+		return nil, fmt.Errorf("-start %s is past the end of the playlist (%s)", formatTimestamp(window.Start), formatTimestamp(total))
+	}
+	return window, nil
+}
+
+// offsetOf converts a clip point to seconds from the start of the playlist
+func offsetOf(point ClipPoint, segments []Segment) (float64, error) {
+	if point.Time.IsZero() {
+		return point.Offset, nil
+	}
+
+	return offsetAtTime(segments, point.Time)
+}
+
+// offsetAtTime converts a date and time to seconds from the start of the
+// segments, using the program date-time of the last segment starting at or
+// before it
+func offsetAtTime(segments []Segment, t time.Time) (float64, error) {
+	offset := -1.0
+	var first time.Time
+	position := 0.0
+	for _, segment := range segments {
+		if !segment.ProgramDateTime.IsZero() {
+			if first.IsZero() {
+				first = segment.ProgramDateTime
+			}
+			if !segment.ProgramDateTime.After(t) || offset < 0 {
+				// Offset of the time within the timeline of this segment
+				offset = position + t.Sub(segment.ProgramDateTime).Seconds()
+			}
+		}
+		position += segment.Duration
+	}
+	if first.IsZero() {
+		return 0, fmt.Errorf("the playlist has no #EXT-X-PROGRAM-DATE-TIME to match %s against", t.Format(time.RFC3339))
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("%s is before the first segment (%s)", t.Format(time.RFC3339), first.Format(time.RFC3339))
+	}
+	return offset, nil
+}
+
+// SequenceWindow returns the window covering the segments with media sequence
+// numbers from to to, inclusive. Either bound can be -1 for no limit.
+func SequenceWindow(segments []Segment, from, to int64) (*ClipWindow, error) {
+	if from >= 0 && to >= 0 && to < from {
+		return nil, fmt.Errorf("-to-seq must not be before -from-seq")
+	}
+
+	window := &ClipWindow{}
+	found := false
+	position := 0.0
+	for _, segment := range segments {
+		if segment.Sequence == from {
+			window.Start = position
+		}
+		position += segment.Duration
+		if segment.Sequence == to {
+			window.End = position
+		}
+		if (from < 0 || segment.Sequence >= from) && (to < 0 || segment.Sequence <= to) {
+			found = true
+		}
+	}
+	if !found {
+		first, last := segments[0].Sequence, segments[len(segments)-1].Sequence
+		return nil, fmt.Errorf("no segments in media sequence range %s (playlist has %d-%d)", sequenceRange(from, to), first, last)
+	}
+	if from >= 0 && from < segments[0].Sequence {
+		fmt.Printf("Warning: media sequence %d is no longer in the playlist, starting at %d\n", from, segments[0].Sequence)
+	}
+	return window, nil
+}
+
+// sequenceRange formats a media sequence range for messages
+func sequenceRange(from, to int64) string {
+	start, end := "first", "last"
+	if from >= 0 {
+		start = strconv.FormatInt(from, 10)
+	}
+	if to >= 0 {
+		end = strconv.FormatInt(to, 10)
+	}
+	return start + "-" + end
+}
+
+// Segments returns the segments overlapping the window and the offset of the
+// first one from the start of the playlist
+func (w *ClipWindow) Segments(segments []Segment) ([]Segment, float64) {
+	var selected []Segment
+	first := 0.0
+	position := 0.0
+	for _, segment := range segments {
+		segmentEnd := position + segment.Duration
+		if segmentEnd > w.Start && (w.End == 0 || position < w.End) {
+			if len(selected) == 0 {
+				first = position
+			}
+			selected = append(selected, segment)
+		}
+		position = segmentEnd
+	}
+	return selected, first
+}
+
+// String describes the window for messages
+func (w *ClipWindow) String() string {
+	if w.End == 0 {
+		return formatTimestamp(w.Start) + " - end"
+	}
+	return formatTimestamp(w.Start) + " - " + formatTimestamp(w.End)
+}
+
+// Apply keeps only the segments of a playlist and its separate audio track
+// that overlap the window. It returns the offset of the window from the start
+// of the first video segment kept.
+func (w *ClipWindow) Apply(playlist *M3U8Playlist) float64 {
+	total := len(playlist.Segments)
+	selected, first := w.Segments(playlist.Segments)
+	playlist.Segments = selected
+	fmt.Printf("✂️  Clipping %s: %d of %d segments\n", w, len(selected), total)
+
+	if playlist.AudioPlaylist != nil {
+		playlist.AudioPlaylist.Segments, _ = w.Segments(playlist.AudioPlaylist.Segments)
+		playlist.AudioSegments = playlist.AudioPlaylist.Segments
+	} else if len(playlist.AudioSegments) > 0 {
+		playlist.AudioSegments, _ = w.Segments(playlist.AudioSegments)
+	}
+	return w.Start - first
+}
+
+// TrimOutput cuts a merged output file to start offset seconds into it and
+// last as long as the window, using ffmpeg
+func TrimOutput(path, mode string, offset float64, w *ClipWindow) error {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(path)
+	trimmed := strings.TrimSuffix(path, ext) + "_trim" + ext
+
+	args := []string{"-ss", strconv.FormatFloat(offset, 'f', 3, 64), "-i", path}
+	if w.End > 0 {
+		args = append(args, "-t", strconv.FormatFloat(w.End-w.Start, 'f', 3, 64))
+	}
+	if mode == TrimExact {
+		args = append(args, "-c:v", "libx264", "-c:a", "aac")
+	} else {
+		args = append(args, "-c", "copy")
+	}
+	args = append(args, "-y", trimmed)
+
+	output, err := exec.Command(ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		os.Remove(trimmed)
+		return fmt.Errorf("ffmpeg trim failed: %w\nOutput: %s", err, string(output))
+	}
+	if err := os.Rename(trimmed, path); err != nil {
+		return fmt.Errorf("failed to replace output with trimmed file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// netscapeHttpOnlyPrefix marks HttpOnly cookies in cookies.txt files
+const netscapeHttpOnlyPrefix = "#HttpOnly_"
+
+// cookieEntry is a cookie as stored in the jar, kept for export
+type cookieEntry struct {
+	cookie   http.Cookie
+	domain   string // Domain without leading dot
+	hostOnly bool   // True if the cookie is not sent to subdomains
+}
+
+// CookieJar is an http.CookieJar that can be seeded from and saved to
+// Netscape cookies.txt files. net/http/cookiejar cannot enumerate its
+// cookies, so every stored cookie is also tracked for export.
+type CookieJar struct {
+	jar     *cookiejar.Jar
+	mu      sync.Mutex
+	entries map[string]cookieEntry
+}
+
+// NewCookieJar creates an empty cookie jar
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(nil) // Only fails with a non-nil options error
+	return &CookieJar{
+		jar:     jar,
+		entries: make(map[string]cookieEntry),
+	}
+}
+
+// SetCookies stores cookies received from a response
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	for _, cookie := range cookies {
+		j.track(u, cookie)
+	}
+}
+
+// track records a cookie passed to the jar for export, or forgets it if it
+// has expired. Cookies the jar rejected, such as those with a Domain the URL
+// can't set, are not recorded. It reports whether the cookie is stored.
+func (j *CookieJar) track(u *url.URL, cookie *http.Cookie) bool {
+	entry := cookieEntry{cookie: *cookie, domain: strings.TrimPrefix(strings.ToLower(cookie.Domain), ".")}
+	if entry.domain == "" {
+		entry.domain = u.Hostname()
+		entry.hostOnly = true
+	}
+	if entry.cookie.Path == "" || !strings.HasPrefix(entry.cookie.Path, "/") {
+		entry.cookie.Path = defaultCookiePath(u)
+	}
+	key := entry.domain + "|" + entry.cookie.Path + "|" + cookie.Name
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	expired := cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now()))
+	if expired {
+		if old, ok := j.entries[key]; ok && !j.holds(old) {
+			delete(j.entries, key)
+		}
+		return false
+	}
+	if !j.holds(entry) {
+		return false
+	}
+	if cookie.MaxAge > 0 {
+		entry.cookie.Expires = time.Now().Add(time.Duration(cookie.MaxAge) * time.Second)
+	}
+	j.entries[key] = entry
+	return true
+}
+
+// holds reports whether the jar sends a cookie back to its own domain and
+// path, which is the case once the jar has accepted it
+func (j *CookieJar) holds(entry cookieEntry) bool {
+	scheme := "http"
+	if entry.cookie.Secure {
+		scheme = "https"
+	}
+	for _, sent := range j.jar.Cookies(&url.URL{Scheme: scheme, Host: entry.domain, Path: entry.cookie.Path}) {
+		if sent.Name == entry.cookie.Name && sent.Value == entry.cookie.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// Cookies returns the cookies to send in a request for the URL
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// defaultCookiePath returns the default cookie path for a URL (RFC 6265 5.1.4)
+func defaultCookiePath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// LoadNetscape seeds the jar from a Netscape cookies.txt file
+func (j *CookieJar) LoadNetscape(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open cookie file: %w", err)
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		httpOnly := false
+		if strings.HasPrefix(line, netscapeHttpOnlyPrefix) {
+			httpOnly = true
+			line = strings.TrimPrefix(line, netscapeHttpOnlyPrefix)
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			return count, fmt.Errorf("invalid cookie on line %d: expected 7 tab-separated fields", lineNumber)
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return count, fmt.Errorf("invalid expiry on line %d: %w", lineNumber, err)
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		secure := strings.EqualFold(fields[3], "TRUE")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    strings.Join(fields[6:], "\t"),
+			Path:     fields[2],
+			Secure:   secure,
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = domain
+		}
+		if expiry > 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(time.Now()) {
+				continue
+			}
+		}
+
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		u := &url.URL{Scheme: scheme, Host: domain, Path: cookie.Path}
+		j.jar.SetCookies(u, []*http.Cookie{cookie})
+		if j.track(u, cookie) {
+			count++
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("error reading cookie file: %w", err)
+	}
+	return count, nil
+}
+
+// SaveNetscape writes all unexpired cookies to a Netscape cookies.txt file
+func (j *CookieJar) SaveNetscape(path string) (int, error) {
+	j.mu.Lock()
+	keys := make([]string, 0, len(j.entries))
+	for key := range j.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString("# Netscape HTTP Cookie File\n")
+	b.WriteString("# Written by m3u8-downloader\n\n")
+
+	count := 0
+	now := time.Now()
+	for _, key := range keys {
+		entry := j.entries[key]
+		cookie := entry.cookie
+		if !cookie.Expires.IsZero() && cookie.Expires.Before(now) {
+			continue
+		}
+
+		domain := entry.domain
+		includeSubdomains := "FALSE"
+		if !entry.hostOnly {
+			domain = "." + domain
+			includeSubdomains = "TRUE"
+		}
+		if cookie.HttpOnly {
+			domain = netscapeHttpOnlyPrefix + domain
+		}
+		var expiry int64
+		if !cookie.Expires.IsZero() {
+			expiry = cookie.Expires.Unix()
+		}
+
+		fmt.Fprintf(&b, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, includeSubdomains, cookie.Path, strings.ToUpper(strconv.FormatBool(cookie.Secure)),
+			expiry, cookie.Name, cookie.Value)
+		count++
+	}
+	j.mu.Unlock()
+
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return 0, fmt.Errorf("failed to write cookie file: %w", err)
+	}
+	return count, nil
+}
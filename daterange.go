@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateRange is a date range declared by #EXT-X-DATERANGE. Tags with the same
+// ID are merged into one DateRange.
+type DateRange struct {
+	ID              string
+	Class           string
+	StartDate       time.Time
+	EndDate         time.Time // Zero if not declared
+	Duration        float64   // DURATION in seconds, 0 if not declared
+	PlannedDuration float64   // PLANNED-DURATION in seconds, 0 if not declared
+	EndOnNext       bool
+	SCTE35Out       string            // SCTE35-OUT splice command, hex
+	SCTE35In        string            // SCTE35-IN splice command, hex
+	SCTE35Cmd       string            // SCTE35-CMD splice command, hex
+	ClientAttrs     map[string]string // X-<name> client attributes
+}
+
+// parseDateRange parses the attributes of an #EXT-X-DATERANGE tag
+func parseDateRange(line string) (DateRange, error) {
+	attrs := parseAttributes(line)
+	dateRange := DateRange{
+		ID:          attrs["ID"],
+		Class:       attrs["CLASS"],
+		EndOnNext:   attrs["END-ON-NEXT"] == "YES",
+		SCTE35Out:   attrs["SCTE35-OUT"],
+		SCTE35In:    attrs["SCTE35-IN"],
+		SCTE35Cmd:   attrs["SCTE35-CMD"],
+		ClientAttrs: make(map[string]string),
+	}
+	if dateRange.ID == "" {
+		return DateRange{}, fmt.Errorf("#EXT-X-DATERANGE without ID")
+	}
+
+	var err error
+	if value := attrs["START-DATE"]; value != "" {
+		if dateRange.StartDate, err = parseProgramDateTime(value); err != nil {
+			return DateRange{}, fmt.Errorf("date range %q: %w", dateRange.ID, err)
+		}
+	}
+	if value := attrs["END-DATE"]; value != "" {
+		if dateRange.EndDate, err = parseProgramDateTime(value); err != nil {
+			return DateRange{}, fmt.Errorf("date range %q: %w", dateRange.ID, err)
+		}
+	}
+	dateRange.Duration, _ = strconv.ParseFloat(attrs["DURATION"], 64)
+	dateRange.PlannedDuration, _ = strconv.ParseFloat(attrs["PLANNED-DURATION"], 64)
+
+	for name, value := range attrs {
+		if strings.HasPrefix(name, "X-") {
+			dateRange.ClientAttrs[name] = value
+		}
+	}
+	return dateRange, nil
+}
+
+// End returns when the date range ends: END-DATE, or the start plus DURATION
+// or PLANNED-DURATION. It is zero if the end is not known yet.
+func (d DateRange) End() time.Time {
+	switch {
+	case !d.EndDate.IsZero():
+		return d.EndDate
+	case d.StartDate.IsZero():
+		return time.Time{}
+	case d.Duration > 0:
+		return d.StartDate.Add(durationOf(d.Duration))
+	case d.PlannedDuration > 0:
+		return d.StartDate.Add(durationOf(d.PlannedDuration))
+	}
+	return time.Time{}
+}
+
+// mergeDateRange adds a date range to a list, merging it into an earlier one
+// with the same ID
+func mergeDateRange(ranges []DateRange, dateRange DateRange) []DateRange {
+	for i := range ranges {
+		if ranges[i].ID != dateRange.ID {
+			continue
+		}
+		merged := &ranges[i]
+		if merged.StartDate.IsZero() {
+			merged.StartDate = dateRange.StartDate
+		}
+		if !dateRange.EndDate.IsZero() {
+			merged.EndDate = dateRange.EndDate
+		}
+		if dateRange.Duration > 0 {
+			merged.Duration = dateRange.Duration
+		}
+		if dateRange.PlannedDuration > 0 {
+			merged.PlannedDuration = dateRange.PlannedDuration
+		}
+		if dateRange.Class != "" {
+			merged.Class = dateRange.Class
+		}
+		if dateRange.SCTE35Out != "" {
+			merged.SCTE35Out = dateRange.SCTE35Out
+		}
+		if dateRange.SCTE35In != "" {
+			merged.SCTE35In = dateRange.SCTE35In
+		}
+		if dateRange.SCTE35Cmd != "" {
+			merged.SCTE35Cmd = dateRange.SCTE35Cmd
+		}
+		merged.EndOnNext = merged.EndOnNext || dateRange.EndOnNext
+		for name, value := range dateRange.ClientAttrs {
+			merged.ClientAttrs[name] = value
+		}
+		return ranges
+	}
+	return append(ranges, dateRange)
+}
+
+// durationOf converts a duration in seconds to a time.Duration
+func durationOf(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 )
 
 // DecryptSegment decrypts an AES-128 encrypted segment
-func DecryptSegment(encryptedData []byte, key []byte, iv string, segmentIndex int) ([]byte, error) {
+func DecryptSegment(encryptedData []byte, key []byte, iv string, sequence int64) ([]byte, error) {
 	// Create AES cipher
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -24,13 +25,10 @@ func DecryptSegment(encryptedData []byte, key []byte, iv string, segmentIndex in
 			return nil, fmt.Errorf("failed to decode IV: %w", err)
 		}
 	} else {
-		// If no IV specified, use the segment sequence number as IV (padded to 16 bytes)
+		// If no IV specified, use the media sequence number as IV (padded to 16 bytes)
 		ivBytes = make([]byte, 16)
-		// Put the segment index in the last 4 bytes (big-endian)
-		ivBytes[12] = byte(segmentIndex >> 24)
-		ivBytes[13] = byte(segmentIndex >> 16)
-		ivBytes[14] = byte(segmentIndex >> 8)
-		ivBytes[15] = byte(segmentIndex)
+		// Put the sequence number in the last 8 bytes (big-endian)
+		binary.BigEndian.PutUint64(ivBytes[8:], uint64(sequence))
 	}
 
 	if len(ivBytes) != aes.BlockSize {
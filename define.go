@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// variableReference matches a {$name} variable reference
+var variableReference = regexp.MustCompile(`\{\$([A-Za-z0-9_-]+)\}`)
+
+// variableName matches a valid #EXT-X-DEFINE variable name
+var variableName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// playlistVariables holds the variables defined with #EXT-X-DEFINE while a
+// playlist is parsed
+type playlistVariables struct {
+	values  map[string]string
+	imports map[string]string // Variables of the master playlist, for IMPORT
+	query   url.Values        // Query parameters of the playlist URL, for QUERYPARAM
+	quiet   bool
+}
+
+// newPlaylistVariables returns an empty variable set for a playlist loaded
+// from baseURL. imports are the variables of its master playlist, if any.
+func newPlaylistVariables(baseURL *url.URL, imports map[string]string, quiet bool) *playlistVariables {
+	return &playlistVariables{
+		values:  make(map[string]string),
+		imports: imports,
+		query:   baseURL.Query(),
+		quiet:   quiet,
+	}
+}
+
+// define adds the variable declared by an #EXT-X-DEFINE tag
+func (v *playlistVariables) define(line string) error {
+	attrs := parseAttributes(line)
+	if _, ok := attrs["QUERYSIGN"]; ok && !v.quiet {
+		fmt.Println("Warning: ignoring unsupported QUERYSIGN attribute of #EXT-X-DEFINE")
+	}
+
+	var name, value string
+	switch {
+	case attrs["NAME"] != "":
+		name = attrs["NAME"]
+		if _, ok := attrs["VALUE"]; !ok {
+			return fmt.Errorf("variable %q has no VALUE", name)
+		}
+		value = attrs["VALUE"]
+	case attrs["IMPORT"] != "":
+		name = attrs["IMPORT"]
+		imported, ok := v.imports[name]
+		if !ok {
+			return fmt.Errorf("cannot import variable %q: not defined by a master playlist", name)
+		}
+		value = imported
+	case attrs["QUERYPARAM"] != "":
+		name = attrs["QUERYPARAM"]
+		if !v.query.Has(name) {
+			return fmt.Errorf("query parameter %q of variable is missing from the playlist URL", name)
+		}
+		value = v.query.Get(name)
+	default:
+		if _, ok := attrs["QUERYSIGN"]; ok {
+			return nil
+		}
+		return fmt.Errorf("invalid #EXT-X-DEFINE %q (expected NAME, IMPORT or QUERYPARAM)", line)
+	}
+
+	if !variableName.MatchString(name) {
+		return fmt.Errorf("invalid variable name %q", name)
+	}
+	if _, ok := v.values[name]; ok {
+		return fmt.Errorf("variable %q is defined more than once", name)
+	}
+	v.values[name] = value
+	return nil
+}
+
+// substitute replaces the variable references in a line with their values
+func (v *playlistVariables) substitute(line string) (string, error) {
+	if !strings.Contains(line, "{$") {
+		return line, nil
+	}
+
+	var undefined string
+	line = variableReference.ReplaceAllStringFunc(line, func(reference string) string {
+		name := variableReference.FindStringSubmatch(reference)[1]
+		value, ok := v.values[name]
+		if !ok {
+			if undefined == "" {
+				undefined = name
+			}
+			return reference
+		}
+		return value
+	})
+	if undefined != "" {
+		return "", fmt.Errorf("variable %q is used but not defined", undefined)
+	}
+	return line, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -21,31 +23,48 @@ type Downloader struct {
 	progress       int32
 	total          int
 	playlist       *M3U8Playlist
-	maxRetries     int
 	totalSize      int64
 	useDiskStorage bool
 	tempDir        string
+	limiter        *ConcurrencyLimiter
+	refresher      *URLRefresher
+	skipErrors     int   // Failed media segments tolerated before the download fails
+	skipped        int32 // Failed media segments tolerated so far
 	mu             sync.Mutex
+	progressMu     sync.Mutex
 }
 
 // NewDownloader creates a new downloader with specified concurrency
-func NewDownloader(maxConcurrent int, playlist *M3U8Playlist, maxRetries int) *Downloader {
+func NewDownloader(maxConcurrent int, playlist *M3U8Playlist) *Downloader {
 	return &Downloader{
 		maxConcurrent:  maxConcurrent,
 		progress:       0,
 		playlist:       playlist,
-		maxRetries:     maxRetries,
 		useDiskStorage: false,
 		totalSize:      0,
+		limiter:        NewConcurrencyLimiter(maxConcurrent, nil, false),
 	}
 }
 
+// SetLimiter replaces the default fixed concurrency limit, e.g. with an
+// adaptive or per-host limiter
+func (d *Downloader) SetLimiter(limiter *ConcurrencyLimiter) {
+	d.limiter = limiter
+}
+
+// SetSkipErrors lets up to n media segments fail without failing the download;
+// they are left out of the merge as gaps
+func (d *Downloader) SetSkipErrors(n int) {
+	d.skipErrors = n
+}
+
 // SegmentData holds a downloaded segment with its index
 type SegmentData struct {
 	Index    int
 	Data     []byte // Used when storing in memory
 	FilePath string // Used when storing on disk
 	Error    error
+	Missing  bool // No media: marked #EXT-X-GAP, or failed and skipped (Error is kept)
 }
 
 // shouldUseDisk checks if we should switch to disk storage
@@ -78,117 +97,266 @@ func (d *Downloader) checkAndSwitchToDisk(newDataSize int) error {
 	return nil
 }
 
-// DownloadSegments downloads all segments concurrently
-func (d *Downloader) DownloadSegments(segments []string) ([]SegmentData, error) {
-	d.total = len(segments)
+// Track is a single media playlist scheduled for download, such as the
+// video, an audio rendition or a subtitle rendition
+type Track struct {
+	Name        string
+	Playlist    *M3U8Playlist
+	Source      string // URL of the rendition being downloaded, as listed in the master playlist
+	Segments    []Segment
+	InitSegment string
+
+	Results  []SegmentData // Downloaded media segments, in playlist order
+	InitData []byte        // Downloaded initialization segment (fMP4 only)
+
+	Renditions []string         // Labels of the renditions segments were downloaded from
+	Failover   *VariantFailover // Switches to another variant when segments keep failing, nil disables
+	Optional   bool             // A failed segment drops the track instead of failing the download
+
+	sources    []int           // Rendition of each segment, index into Renditions
+	initSource int             // Rendition of the init segment
+	initShared *Track          // Track fetching the same init segment for this one, if any
+	playlists  []*M3U8Playlist // Playlist of each rendition, carrying its key
+	done       []bool          // Segments downloaded successfully
+
+	progress  int32
+	succeeded int32
+	dropped   int32      // Set once an optional track has been dropped
+	mu        sync.Mutex // Guards segment URLs, which change when refreshed or switched
+}
+
+// jobURL returns the current URL of a segment, or of the init segment for index -1
+func (t *Track) jobURL(index int) string {
+	url, _ := t.jobSource(index)
+	return url
+}
 
-	// For fMP4, just note that we'll handle init segment during merge
-	if d.playlist.IsFragmented && d.playlist.InitSegment != "" {
-		fmt.Printf("ℹ️  Fragmented MP4 format detected\n")
-		fmt.Printf("   Initialization segment: %s\n", d.playlist.InitSegment)
-		fmt.Printf("   Media segments: %d\n", len(segments))
+// jobSource returns the current URL of a segment and the playlist of the
+// rendition it belongs to
+func (t *Track) jobSource(index int) (string, *M3U8Playlist) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index < 0 {
+		return t.InitSegment, t.playlists[t.initSource]
 	}
+	return t.Segments[index].URL, t.playlists[t.sources[index]]
+}
 
-	results := make([]SegmentData, len(segments))
+// currentPlaylist returns the playlist of the rendition being downloaded
+func (t *Track) currentPlaylist() *M3U8Playlist {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Playlist
+}
 
-	// Create a semaphore to limit concurrent downloads
-	semaphore := make(chan struct{}, d.maxConcurrent)
-	var wg sync.WaitGroup
-	resultChan := make(chan SegmentData, len(segments))
+// currentSource returns the URL of the rendition being downloaded
+func (t *Track) currentSource() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Source
+}
+
+// markDone records that a segment was downloaded, so switching renditions
+// leaves it alone
+func (t *Track) markDone(index int) {
+	if index < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done[index] = true
+}
+
+// Dropped reports whether an optional track was dropped because one of its
+// segments failed
+func (t *Track) Dropped() bool {
+	return atomic.LoadInt32(&t.dropped) != 0
+}
+
+// withoutDropped returns the tracks that were not dropped
+func withoutDropped(tracks []*Track) []*Track {
+	var kept []*Track
+	for _, track := range tracks {
+		if !track.Dropped() {
+			kept = append(kept, track)
+		}
+	}
+	return kept
+}
+
+// SetRefresher enables refreshing expired segment URLs from the playlist
+func (d *Downloader) SetRefresher(refresher *URLRefresher) {
+	d.refresher = refresher
+}
+
+// NewTrack creates a track for the media segments of a playlist
+func NewTrack(name string, playlist *M3U8Playlist) *Track {
+	track := newTrack(name, playlist, playlist.Segments)
+	if playlist.IsFragmented {
+		track.InitSegment = playlist.InitSegment
+	}
+	return track
+}
+
+// newTrack creates a track for a list of segments of a playlist
+func newTrack(name string, playlist *M3U8Playlist, segments []Segment) *Track {
+	label := playlist.URL
+	if playlist.Variant != nil {
+		label = playlist.Variant.String()
+	}
+	return &Track{
+		Name:       name,
+		Playlist:   playlist,
+		Source:     playlist.URL,
+		Segments:   segments,
+		Renditions: []string{label},
+		sources:    make([]int, len(segments)),
+		playlists:  []*M3U8Playlist{playlist},
+		done:       make([]bool, len(segments)),
+	}
+}
 
-	// Start downloading segments
-	for i, segmentURL := range segments {
-		wg.Add(1)
-		go func(index int, url string) {
-			defer wg.Done()
+// downloadJob is a single fetch in the download graph
+type downloadJob struct {
+	track *Track
+	index int // Segment index, or -1 for the initialization segment
+}
 
-			// Acquire semaphore
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+// String describes the job for messages
+func (j downloadJob) String() string {
+	if j.index < 0 {
+		return j.track.Name + " initialization segment"
+	}
+	return fmt.Sprintf("%s segment %d", j.track.Name, j.index)
+}
 
-			// Download the segment with retry
-			data, err := DownloadContentWithRetry(url, d.maxRetries)
+// DownloadSegments downloads all segments of the downloader's playlist concurrently
+func (d *Downloader) DownloadSegments(segments []Segment) ([]SegmentData, error) {
+	track := newTrack("segment", d.playlist, segments)
+	if err := d.DownloadTracks([]*Track{track}); err != nil {
+		return nil, err
+	}
+	return track.Results, nil
+}
 
-			if err != nil {
-				resultChan <- SegmentData{
-					Index: index,
-					Error: err,
+// DownloadTracks downloads the segments of all tracks as one job graph.
+// Initialization segments are fetched first, once for tracks sharing the
+// same one, then media segments of all tracks are interleaved so every
+// track progresses under the shared concurrency limit.
+func (d *Downloader) DownloadTracks(tracks []*Track) error {
+	var jobs []downloadJob
+	initTracks := make(map[string]*Track) // Track fetching each init segment
+	for _, track := range tracks {
+		track.Results = make([]SegmentData, len(track.Segments))
+		if track.InitSegment == "" {
+			continue
+		}
+		if owner, ok := initTracks[track.InitSegment]; ok {
+			fmt.Printf("ℹ️  Fragmented MP4 %s track shares the initialization segment of the %s track\n", track.Name, owner.Name)
+			track.initShared = owner
+			continue
+		}
+		initTracks[track.InitSegment] = track
+		fmt.Printf("ℹ️  Fragmented MP4 %s track, initialization segment: %s\n", track.Name, track.InitSegment)
+		jobs = append(jobs, downloadJob{track: track, index: -1})
+	}
+	for i := 0; ; i++ {
+		added := false
+		for _, track := range tracks {
+			if i < len(track.Segments) {
+				jobs = append(jobs, downloadJob{track: track, index: i})
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	d.total = len(jobs)
+
+	// The limiter bounds concurrent downloads across all tracks
+	var wg sync.WaitGroup
+	errorChan := make(chan error, len(jobs))
+
+	// Jobs are queued per host, so a host at its limit (such as a key server
+	// throttled after a 429) doesn't hold up jobs for other hosts
+	var queues [][]int // Indexes into jobs, in order, for each host
+	queueOf := make(map[string]int)
+	for i, job := range jobs {
+		host := hostOf(job.track.jobURL(job.index))
+		q, ok := queueOf[host]
+		if !ok {
+			q = len(queues)
+			queueOf[host] = q
+			queues = append(queues, nil)
+		}
+		queues[q] = append(queues[q], i)
+	}
+
+	// Start the earliest queued job whose host has a free slot
+	go func() {
+		for started := 0; started < len(jobs); started++ {
+			var heads []int
+			for q := range queues {
+				if len(queues[q]) > 0 {
+					heads = append(heads, q)
 				}
-				atomic.AddInt32(&d.progress, 1)
-				return
+			}
+			sort.Slice(heads, func(i, j int) bool {
+				return queues[heads[i]][0] < queues[heads[j]][0]
+			})
+			hosts := make([]string, len(heads))
+			for i, q := range heads {
+				next := jobs[queues[q][0]]
+				hosts[i] = hostOf(next.track.jobURL(next.index))
 			}
 
-			// Decrypt if necessary
-			if d.playlist.Encrypted {
-				data, err = DecryptSegment(data, d.playlist.Key, d.playlist.KeyIV, index)
-				if err != nil {
-					resultChan <- SegmentData{
-						Index: index,
-						Error: fmt.Errorf("decryption failed: %w", err),
-					}
+			chosen := d.limiter.AcquireFirst(hosts)
+			q := heads[chosen]
+			job, host := jobs[queues[q][0]], hosts[chosen]
+			queues[q] = queues[q][1:]
+			wg.Add(1)
+			go func(job downloadJob, host string) {
+				defer wg.Done()
+				defer d.limiter.Release(host)
+
+				// The rest of a dropped track is not fetched
+				if job.track.Dropped() {
+					atomic.AddInt32(&job.track.progress, 1)
 					atomic.AddInt32(&d.progress, 1)
 					return
 				}
-			}
 
-			// Check if we should switch to disk storage
-			err = d.checkAndSwitchToDisk(len(data))
-			if err != nil {
-				resultChan <- SegmentData{
-					Index: index,
-					Error: fmt.Errorf("storage check failed: %w", err),
-				}
+				result := d.runJob(job)
+				atomic.AddInt32(&job.track.progress, 1)
 				atomic.AddInt32(&d.progress, 1)
-				return
-			}
+				d.printProgress(tracks, job, result.Error)
 
-			var segmentData SegmentData
-			segmentData.Index = index
-
-			// Store based on storage mode
-			if d.shouldUseDisk() {
-				// Save to temp file
-				tempFile := filepath.Join(d.tempDir, fmt.Sprintf("segment_%06d.ts", index))
-				err = os.WriteFile(tempFile, data, 0644)
-				if err != nil {
-					segmentData.Error = fmt.Errorf("failed to write temp file: %w", err)
-				} else {
-					segmentData.FilePath = tempFile
+				if result.Error != nil && job.track.Optional {
+					if atomic.CompareAndSwapInt32(&job.track.dropped, 0, 1) {
+						fmt.Printf("\n⚠️  Dropping the %s track, %s failed: %v\n", job.track.Name, job, result.Error)
+					}
+					return
+				} else if result.Error != nil && job.index >= 0 && atomic.AddInt32(&d.skipped, 1) <= int32(d.skipErrors) {
+					fmt.Printf("\n⚠️  Skipping %s: %v\n", job, result.Error)
+					result.Missing = true
+				} else if result.Error != nil {
+					errorChan <- fmt.Errorf("%s: %w", job, result.Error)
+					return
 				}
-			} else {
-				// Store in memory
-				segmentData.Data = data
-			}
-
-			// Update progress
-			current := atomic.AddInt32(&d.progress, 1)
-			if segmentData.Error == nil {
-				fmt.Printf("\rDownloading segments: %d/%d (%.1f%%) [%s]",
-					current, d.total, float64(current)/float64(d.total)*100,
-					formatBytes(d.totalSize))
-			} else {
-				fmt.Printf("\rDownloading segments: %d/%d (%.1f%%) - Error on segment %d",
-					current, d.total, float64(current)/float64(d.total)*100, index)
-			}
-
-			resultChan <- segmentData
-		}(i, segmentURL)
-	}
-
-	// Wait for all downloads to complete
-	go func() {
+				if job.index >= 0 {
+					job.track.Results[job.index] = result
+				}
+			}(job, host)
+		}
 		wg.Wait()
-		close(resultChan)
+		close(errorChan)
 	}()
 
-	// Collect results
+	// Wait for all downloads to complete and collect errors
 	var errors []error
-	for result := range resultChan {
-		if result.Error != nil {
-			errors = append(errors, fmt.Errorf("segment %d: %w", result.Index, result.Error))
-		} else {
-			results[result.Index] = result
-		}
+	for err := range errorChan {
+		errors = append(errors, err)
 	}
 
 	fmt.Println() // New line after progress
@@ -198,7 +366,12 @@ func (d *Downloader) DownloadSegments(segments []string) ([]SegmentData, error)
 		if d.tempDir != "" {
 			os.RemoveAll(d.tempDir)
 		}
-		return nil, fmt.Errorf("failed to download %d segments: %v", len(errors), errors[0])
+		return fmt.Errorf("failed to download %d segments: %v", len(errors), errors[0])
+	}
+	for _, track := range tracks {
+		if track.initShared != nil {
+			track.InitData = track.initShared.InitData
+		}
 	}
 
 	if d.useDiskStorage {
@@ -207,7 +380,145 @@ func (d *Downloader) DownloadSegments(segments []string) ([]SegmentData, error)
 		fmt.Printf("✓ Segments stored in memory (%s)\n", formatBytes(d.totalSize))
 	}
 
-	return results, nil
+	return nil
+}
+
+// runJob downloads, decrypts and stores a single job
+func (d *Downloader) runJob(job downloadJob) SegmentData {
+	segmentData := SegmentData{Index: job.index}
+
+	// Segments marked #EXT-X-GAP don't exist on the server
+	if job.index >= 0 && job.track.Segments[job.index].Gap {
+		segmentData.Missing = true
+		return segmentData
+	}
+
+	// Download the segment with retry
+	url, playlist := job.track.jobSource(job.index)
+	data, err := d.fetch(job, url)
+
+	// Signed URLs may expire during long downloads; refresh them from the
+	// playlist if segments of this track used to work
+	for err != nil && d.refresher != nil && isAuthExpired(err) && atomic.LoadInt32(&job.track.succeeded) > 0 {
+		if !d.refresher.Refresh(job.track, job.index, url) {
+			break
+		}
+		url, playlist = job.track.jobSource(job.index)
+		data, err = d.fetch(job, url)
+	}
+
+	// Try the mirrors of the segment's host in turn
+	if err != nil {
+		failedURL := url
+		for _, mirrorURL := range mirrorURLs(url) {
+			fmt.Printf("\n🪞 %s failed on %s (%v), trying mirror %s\n", job, hostOf(failedURL), err, hostOf(mirrorURL))
+			if data, err = d.fetch(job, mirrorURL); err == nil {
+				break
+			}
+			failedURL = mirrorURL
+		}
+	}
+
+	// Switch the rest of the track to a backup or lower variant
+	for err != nil && job.track.Failover != nil && job.track.Failover.Switch(job.track, job.index, url) {
+		url, playlist = job.track.jobSource(job.index)
+		data, err = d.fetch(job, url)
+	}
+	if err != nil {
+		segmentData.Error = err
+		return segmentData
+	}
+	atomic.AddInt32(&job.track.succeeded, 1)
+	job.track.markDone(job.index)
+
+	// Initialization segments are small and kept in memory
+	if job.index < 0 {
+		job.track.InitData = data
+		return segmentData
+	}
+
+	// Decrypt if necessary
+	if playlist.Encrypted {
+		data, err = DecryptSegment(data, playlist.Key, playlist.KeyIV, job.track.Segments[job.index].Sequence)
+		if err != nil {
+			segmentData.Error = fmt.Errorf("decryption failed: %w", err)
+			return segmentData
+		}
+	}
+
+	// Check if we should switch to disk storage
+	err = d.checkAndSwitchToDisk(len(data))
+	if err != nil {
+		segmentData.Error = fmt.Errorf("storage check failed: %w", err)
+		return segmentData
+	}
+
+	// Store based on storage mode
+	if d.shouldUseDisk() {
+		// Save to temp file
+		tempFile := filepath.Join(d.tempDir, fmt.Sprintf("%s_%06d.ts", job.track.Name, job.index))
+		err = os.WriteFile(tempFile, data, 0644)
+		if err != nil {
+			segmentData.Error = fmt.Errorf("failed to write temp file: %w", err)
+		} else {
+			segmentData.FilePath = tempFile
+		}
+	} else {
+		// Store in memory
+		segmentData.Data = data
+	}
+
+	return segmentData
+}
+
+// fetch downloads a job's URL with retry
+func (d *Downloader) fetch(job downloadJob, url string) ([]byte, error) {
+	class := ClassSegment
+	if job.index < 0 {
+		class = ClassInit
+	}
+	host := hostOf(url)
+	data, _, err := downloadWithRetry(url, class, job.track.currentPlaylist().IsLive, func(bytes int, err error) {
+		d.limiter.Observe(host, bytes, err)
+	})
+	return data, err
+}
+
+// printProgress prints combined progress across all tracks
+func (d *Downloader) printProgress(tracks []*Track, job downloadJob, err error) {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+
+	current := atomic.LoadInt32(&d.progress)
+	percent := float64(current) / float64(d.total) * 100
+
+	if err != nil {
+		fmt.Printf("\rDownloading: %d/%d (%.1f%%) - Error on %s segment %d",
+			current, d.total, percent, job.track.Name, job.index)
+		return
+	}
+
+	line := fmt.Sprintf("\rDownloading: %d/%d (%.1f%%) [%s]", current, d.total, percent, formatBytes(d.downloadedSize()))
+	if len(tracks) > 1 {
+		parts := make([]string, 0, len(tracks))
+		for _, track := range tracks {
+			total := len(track.Segments)
+			if track.InitSegment != "" && track.initShared == nil {
+				// Tracks sharing an init segment don't download it
+				total++
+			}
+			parts = append(parts, fmt.Sprintf("%s %d/%d", track.Name, atomic.LoadInt32(&track.progress), total))
+		}
+		line += " " + strings.Join(parts, ", ")
+	}
+	fmt.Print(line)
+}
+
+// downloadedSize returns the total size of stored segments
+func (d *Downloader) downloadedSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.totalSize
 }
 
 // CleanupTempFiles removes temporary files if they were used
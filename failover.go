@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultPathway is the pathway of variants without a PATHWAY-ID attribute
+const defaultPathway = "."
+
+// Variant is a variant stream declared by #EXT-X-STREAM-INF in a master playlist
+type Variant struct {
+	URL        string
+	Bandwidth  int64
+	Resolution string
+	Codecs     string
+	FrameRate  string // FRAME-RATE, if declared
+	PathwayID  string // Content steering pathway (PATHWAY-ID)
+}
+
+// parseVariant parses the attributes of an #EXT-X-STREAM-INF tag
+func parseVariant(line string) Variant {
+	attrs := parseAttributes(line)
+	bandwidth, _ := strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+	variant := Variant{
+		Bandwidth:  bandwidth,
+		Resolution: attrs["RESOLUTION"],
+		Codecs:     attrs["CODECS"],
+		FrameRate:  attrs["FRAME-RATE"],
+		PathwayID:  attrs["PATHWAY-ID"],
+	}
+	if variant.PathwayID == "" {
+		variant.PathwayID = defaultPathway
+	}
+	return variant
+}
+
+// String describes the variant for messages and reports
+func (v Variant) String() string {
+	var parts []string
+	if v.Resolution != "" {
+		parts = append(parts, v.Resolution)
+	}
+	if v.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("%d kbps", v.Bandwidth/1000))
+	}
+	if host := hostOf(v.URL); host != "" {
+		parts = append(parts, "via "+host)
+	}
+	if v.PathwayID != defaultPathway && v.PathwayID != "" {
+		parts = append(parts, "pathway "+v.PathwayID)
+	}
+	if len(parts) == 0 {
+		return v.URL
+	}
+	return strings.Join(parts, ", ")
+}
+
+// contentSteering is an #EXT-X-CONTENT-STEERING declaration
+type contentSteering struct {
+	ServerURI string // Steering manifest URL
+	PathwayID string // Pathway to use until the steering manifest is loaded
+}
+
+// steeringManifest is the JSON document served by a content steering server
+type steeringManifest struct {
+	Version         int      `json:"VERSION"`
+	PathwayPriority []string `json:"PATHWAY-PRIORITY"`
+}
+
+// priority returns the pathways in order of preference. The steering manifest
+// is loaded once; if that fails the default pathway is preferred.
+func (s *contentSteering) priority() []string {
+	var pathways []string
+	if s.ServerURI != "" {
+		manifest, err := s.load()
+		if err != nil {
+			fmt.Printf("Warning: failed to load content steering manifest: %v\n", err)
+		} else {
+			pathways = manifest.PathwayPriority
+		}
+	}
+	if len(pathways) == 0 && s.PathwayID != "" {
+		pathways = []string{s.PathwayID}
+	}
+	return pathways
+}
+
+// load fetches the steering manifest, announcing the default pathway
+func (s *contentSteering) load() (*steeringManifest, error) {
+	manifestURL := s.ServerURI
+	if s.PathwayID != "" {
+		if parsed, err := url.Parse(manifestURL); err == nil {
+			query := parsed.Query()
+			query.Set("_HLS_pathway", s.PathwayID)
+			parsed.RawQuery = query.Encode()
+			manifestURL = parsed.String()
+		}
+	}
+
+	data, err := DownloadContentWithRetry(manifestURL, ClassPlaylist, false)
+	if err != nil {
+		return nil, err
+	}
+	var manifest steeringManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid steering manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// orderByPathway sorts variants by the rank of their pathway, keeping the
+// declared order within a pathway. Pathways missing from the list come last.
+func orderByPathway(variants []Variant, pathways []string) []Variant {
+	rank := make(map[string]int, len(pathways))
+	for i, pathway := range pathways {
+		if _, ok := rank[pathway]; !ok {
+			rank[pathway] = i
+		}
+	}
+	rankOf := func(v Variant) int {
+		if r, ok := rank[v.PathwayID]; ok {
+			return r
+		}
+		return len(pathways)
+	}
+
+	ordered := append([]Variant(nil), variants...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rankOf(ordered[i]) < rankOf(ordered[j])
+	})
+	return ordered
+}
+
+// redundantVariants returns the other copies of a variant: variants with the
+// same bandwidth served from a different URL
+func redundantVariants(variants []Variant, current Variant) []Variant {
+	var backups []Variant
+	for _, variant := range variants {
+		if variant.Bandwidth == current.Bandwidth && variant.URL != current.URL {
+			backups = append(backups, variant)
+		}
+	}
+	return backups
+}
+
+// failoverCandidates returns the variants to switch to when the current one
+// keeps failing: redundant backups first, then lower bandwidths, highest first
+func failoverCandidates(variants []Variant, current Variant) []Variant {
+	candidates := redundantVariants(variants, current)
+
+	var lower []Variant
+	for _, variant := range variants {
+		if variant.Bandwidth < current.Bandwidth {
+			lower = append(lower, variant)
+		}
+	}
+	sort.SliceStable(lower, func(i, j int) bool {
+		return lower[i].Bandwidth > lower[j].Bandwidth
+	})
+	return append(candidates, lower...)
+}
+
+// withoutAudioOnly leaves out the audio-only variants, so a video track does
+// not switch to audio partway through
+func withoutAudioOnly(variants []Variant) []Variant {
+	var kept []Variant
+	for _, variant := range variants {
+		if !isAudioOnlyVariant(variant) {
+			kept = append(kept, variant)
+		}
+	}
+	return kept
+}
+
+// VariantFailover switches a track to a backup or lower variant of the master
+// playlist when its segments keep failing
+type VariantFailover struct {
+	Candidates []Variant         // Variants not tried yet, in order of preference
+	CustomKey  []byte            // Custom key passed to the parser
+	Imports    map[string]string // Master playlist variables
+
+	mu      sync.Mutex
+	current Variant
+}
+
+// NewVariantFailover returns a failover for a playlist selected from a master
+// playlist, or nil if there is nothing to fail over to. Fragmented MP4 tracks
+// only switch to redundant backups, since other renditions need their own
+// initialization segment, and video tracks never switch to audio-only
+// variants.
+func NewVariantFailover(playlist *M3U8Playlist, customKey []byte) *VariantFailover {
+	if playlist.Variant == nil {
+		return nil
+	}
+
+	var candidates []Variant
+	if playlist.IsFragmented {
+		candidates = redundantVariants(playlist.Variants, *playlist.Variant)
+	} else {
+		candidates = failoverCandidates(playlist.Variants, *playlist.Variant)
+	}
+	if !isAudioOnlyVariant(*playlist.Variant) {
+		candidates = withoutAudioOnly(candidates)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return &VariantFailover{
+		Candidates: candidates,
+		CustomKey:  customKey,
+		Imports:    playlist.Imports,
+		current:    *playlist.Variant,
+	}
+}
+
+// Switch moves the remaining segments of a track to the next candidate
+// variant that has the segment at index. failedURL is the URL that failed for
+// that segment. It returns false once every candidate has been tried.
+func (f *VariantFailover) Switch(track *Track, index int, failedURL string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Another worker already switched this segment
+	if track.jobURL(index) != failedURL {
+		return true
+	}
+
+	for len(f.Candidates) > 0 {
+		candidate := f.Candidates[0]
+		f.Candidates = f.Candidates[1:]
+
+		kind := "lower variant"
+		if candidate.Bandwidth == f.current.Bandwidth {
+			kind = "backup"
+		}
+		fmt.Printf("\n🔀 %s keeps failing on %s, switching to %s %s\n", track.Name, f.current, kind, candidate)
+
+		fresh, err := parseMediaPlaylist(candidate.URL, f.CustomKey, f.Imports)
+		if err != nil {
+			fmt.Printf("Warning: failed to load %s playlist: %v\n", kind, err)
+			continue
+		}
+
+		switched := track.switchRendition(fresh, candidate.String(), index)
+		if switched == 0 {
+			fmt.Printf("Warning: %s has no segment with media sequence %d, skipping it\n", kind, track.sequenceOf(index))
+			continue
+		}
+
+		fmt.Printf("✓ Moved %d remaining %s segment(s) to %s\n", switched, track.Name, candidate)
+		f.current = candidate
+		return true
+	}
+
+	return false
+}
+
+// switchRendition moves the segments that have not been downloaded yet to a
+// new rendition, aligned by media sequence number. Nothing changes unless the
+// rendition has the segment at index. It returns the number of segments moved.
+func (t *Track) switchRendition(fresh *M3U8Playlist, label string, index int) int {
+	bySequence := make(map[int64]string, len(fresh.Segments))
+	for _, segment := range fresh.Segments {
+		bySequence[segment.Sequence] = segment.URL
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if index >= 0 {
+		if _, ok := bySequence[t.Segments[index].Sequence]; !ok {
+			return 0
+		}
+	} else if fresh.InitSegment == "" {
+		return 0
+	}
+
+	source := len(t.Renditions)
+	t.Renditions = append(t.Renditions, label)
+	t.playlists = append(t.playlists, fresh)
+
+	switched := 0
+	for i := range t.Segments {
+		if t.done[i] {
+			continue
+		}
+		if newURL, ok := bySequence[t.Segments[i].Sequence]; ok {
+			t.Segments[i].URL = newURL
+			t.sources[i] = source
+			switched++
+		}
+	}
+	if t.InitData == nil && fresh.InitSegment != "" && t.InitSegment != "" {
+		t.InitSegment = fresh.InitSegment
+		t.initSource = source
+		switched++
+	}
+	t.Playlist = fresh
+	t.Source = fresh.URL
+
+	return switched
+}
+
+// sequenceOf returns the media sequence number of a segment
+func (t *Track) sequenceOf(index int) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index < 0 {
+		return -1
+	}
+	return t.Segments[index].Sequence
+}
+
+// RenditionReport lists which ranges of segments were downloaded from which
+// rendition, one line per range
+func (t *Track) RenditionReport() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var lines []string
+	for start := 0; start < len(t.sources); {
+		end := start
+		for end+1 < len(t.sources) && t.sources[end+1] == t.sources[start] {
+			end++
+		}
+		span := fmt.Sprintf("segment %d", start)
+		if end > start {
+			span = fmt.Sprintf("segments %d-%d", start, end)
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", span, t.Renditions[t.sources[start]]))
+		start = end + 1
+	}
+	return lines
+}
@@ -123,9 +123,11 @@ func downloadFFmpeg() error {
 		return fmt.Errorf("failed to create ffmpeg directory: %w", err)
 	}
 
-	// Create a dedicated HTTP client for ffmpeg download with longer timeout
+	// Create a dedicated HTTP client for ffmpeg download with longer timeout,
+	// sharing the proxy and TLS settings of the main client
 	ffmpegClient := &http.Client{
-		Timeout: 30 * time.Minute, // 30 minutes for large download
+		Timeout:   30 * time.Minute, // 30 minutes for large download
+		Transport: httpClient.Transport,
 	}
 
 	// Download the file
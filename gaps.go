@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Gap filler kinds for -gap-filler
+const (
+	FillerNone    = "none"    // Leave gaps out of the output
+	FillerBlack   = "black"   // Black video with silent audio
+	FillerSilence = "silence" // Silent audio only, for audio tracks
+)
+
+// parseGapFiller validates a -gap-filler value
+func parseGapFiller(value string) (string, error) {
+	switch value {
+	case FillerNone, FillerBlack, FillerSilence:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid gap filler %q (expected none, black or silence)", value)
+}
+
+// GapRange is a stretch of a track with no downloaded media
+type GapRange struct {
+	Track  string
+	Index  int     // Segment index
+	Start  float64 // Seconds from the start of the track
+	End    float64
+	Reason string // "EXT-X-GAP" or the download error
+}
+
+// Gaps returns the segments of a track that have no media, with their time
+// ranges computed from the segment durations
+func (t *Track) Gaps() []GapRange {
+	var gaps []GapRange
+	position := 0.0
+	for i, segment := range t.Segments {
+		if i < len(t.Results) && t.Results[i].Missing {
+			reason := "EXT-X-GAP"
+			if t.Results[i].Error != nil {
+				reason = t.Results[i].Error.Error()
+			}
+			gaps = append(gaps, GapRange{
+				Track:  t.Name,
+				Index:  i,
+				Start:  position,
+				End:    position + segment.Duration,
+				Reason: reason,
+			})
+		}
+		position += segment.Duration
+	}
+	return gaps
+}
+
+// formatTimestamp formats seconds as HH:MM:SS.mmm
+func formatTimestamp(seconds float64) string {
+	millis := int64(seconds*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// WriteGapReport writes one line per gap with its time range, track, segment
+// and reason
+func WriteGapReport(path string, gaps []GapRange) error {
+	var b strings.Builder
+	total := 0.0
+	for _, gap := range gaps {
+		fmt.Fprintf(&b, "%s - %s\t%s segment %d\t%s\n",
+			formatTimestamp(gap.Start), formatTimestamp(gap.End), gap.Track, gap.Index, gap.Reason)
+		total += gap.End - gap.Start
+	}
+	fmt.Fprintf(&b, "# %d gap(s), %.3f seconds missing\n", len(gaps), total)
+
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write gap report: %w", err)
+	}
+	return nil
+}
+
+// FillGaps replaces the missing segments of an MPEG-TS track with generated
+// filler of the same duration, matching the codecs and PIDs of the track's
+// downloaded segments and starting at the gap's timestamp. The picture size
+// and frame rate of black video come from the track's variant. It returns the
+// number of segments filled.
+func FillGaps(track *Track, kind string) (int, error) {
+	if kind == FillerNone {
+		return 0, nil
+	}
+	if track.Playlist.IsFragmented || trackPackedAudio(track) != "" {
+		return 0, fmt.Errorf("gap filler is only supported for MPEG-TS segments")
+	}
+
+	format, err := trackFillerFormat(track, kind)
+	if err != nil {
+		return 0, err
+	}
+	filled := 0
+	for i := range track.Results {
+		if !track.Results[i].Missing {
+			continue
+		}
+		duration := strconv.FormatFloat(track.Segments[i].Duration, 'f', 3, 64)
+		data, err := generateFiller(format, duration, fillerOffset(track, i))
+		if err != nil {
+			return filled, err
+		}
+		track.Results[i].Data = data
+		filled++
+	}
+	return filled, nil
+}
+
+// fillerFormat is what generated filler has to match to be spliced into a
+// track
+type fillerFormat struct {
+	Video      string // ffmpeg video encoder, "" for no video
+	Audio      string // ffmpeg audio encoder, "" for no audio
+	VideoPID   int    // 0 leaves the PID to ffmpeg
+	AudioPID   int
+	PMTPID     int
+	Resolution string
+	FrameRate  string
+}
+
+// Encoders for the MPEG-TS stream types a filler can be generated in
+var (
+	fillerVideoEncoders = map[byte]string{
+		0x02: "mpeg2video",
+		0x1b: "libx264",
+		0x24: "libx265",
+	}
+	fillerAudioEncoders = map[byte]string{
+		0x03: "libmp3lame",
+		0x04: "libmp3lame",
+		0x0f: "aac",
+		0x81: "ac3",
+		0x87: "eac3",
+	}
+)
+
+// trackFillerFormat matches the filler to the first stream of each kind in
+// the program map table of a downloaded segment of the track. Without one,
+// the filler is H.264 and AAC.
+func trackFillerFormat(track *Track, kind string) (fillerFormat, error) {
+	format := fillerFormat{Video: "libx264", Audio: "aac", Resolution: "1280x720", FrameRate: "25"}
+	if variant := track.Playlist.Variant; variant != nil {
+		if variant.Resolution != "" {
+			format.Resolution = variant.Resolution
+		}
+		if variant.FrameRate != "" {
+			format.FrameRate = variant.FrameRate
+		}
+	}
+
+	for _, result := range track.Results {
+		if result.Missing {
+			continue
+		}
+		data, err := segmentBytes(result)
+		if err != nil || len(data) == 0 || data[0] != tsSyncByte {
+			continue
+		}
+		metadata := demuxTS(data)
+		if len(metadata.Streams) == 0 {
+			continue
+		}
+		format.Video, format.Audio = "", ""
+		format.PMTPID = metadata.PMTPID
+		for _, stream := range metadata.Streams {
+			if encoder, ok := fillerVideoEncoders[stream.Type]; ok && format.Video == "" {
+				format.Video, format.VideoPID = encoder, stream.PID
+			}
+			if encoder, ok := fillerAudioEncoders[stream.Type]; ok && format.Audio == "" {
+				format.Audio, format.AudioPID = encoder, stream.PID
+			}
+		}
+		break
+	}
+
+	if kind != FillerBlack {
+		format.Video = ""
+	}
+	if format.Video == "" && format.Audio == "" {
+		return format, fmt.Errorf("no filler can be generated for the %s track's streams", track.Name)
+	}
+	return format, nil
+}
+
+// fillerOffset returns the timestamp in seconds at which the filler of
+// missing segment i starts, counted from the first PTS of the nearest
+// downloaded segment, or -1 if no downloaded segment has one
+func fillerOffset(track *Track, i int) float64 {
+	firstPTS := func(j int) int64 {
+		if track.Results[j].Missing {
+			return -1
+		}
+		data, err := segmentBytes(track.Results[j])
+		if err != nil || len(data) == 0 || data[0] != tsSyncByte {
+			return -1
+		}
+		return demuxTS(data).FirstPTS
+	}
+
+	wrap := float64(ptsWrap) / 90000
+	between := 0.0
+	for j := i - 1; j >= 0; j-- {
+		between += track.Segments[j].Duration
+		if pts := firstPTS(j); pts >= 0 {
+			return math.Mod(float64(pts)/90000+between, wrap)
+		}
+	}
+	between = 0
+	for j := i + 1; j < len(track.Results); j++ {
+		between += track.Segments[j-1].Duration
+		if pts := firstPTS(j); pts >= 0 {
+			return math.Mod(float64(pts)/90000-between+wrap, wrap)
+		}
+	}
+	return -1
+}
+
+// segmentBytes returns the data of a downloaded segment, from memory or disk
+func segmentBytes(result SegmentData) ([]byte, error) {
+	if result.FilePath != "" {
+		return os.ReadFile(result.FilePath)
+	}
+	return result.Data, nil
+}
+
+// generateFiller renders a black or silent MPEG-TS segment in format with
+// ffmpeg, with timestamps starting at offset seconds unless it is negative
+func generateFiller(format fillerFormat, duration string, offset float64) ([]byte, error) {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp("", "m3u8-filler-*.ts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create filler file: %w", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	var args []string
+	var output int // Output stream index, for -streamid
+	if format.Video != "" {
+		args = append(args, "-f", "lavfi", "-i", "color=c=black:s="+format.Resolution+":r="+format.FrameRate)
+	}
+	if format.Audio != "" {
+		args = append(args, "-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo")
+	}
+	if format.Video != "" {
+		args = append(args, "-c:v", format.Video, "-pix_fmt", "yuv420p")
+		if format.VideoPID != 0 {
+			args = append(args, "-streamid", fmt.Sprintf("%d:%d", output, format.VideoPID))
+		}
+		output++
+	}
+	if format.Audio != "" {
+		args = append(args, "-c:a", format.Audio)
+		if format.AudioPID != 0 {
+			args = append(args, "-streamid", fmt.Sprintf("%d:%d", output, format.AudioPID))
+		}
+	}
+	if format.PMTPID != 0 {
+		args = append(args, "-mpegts_pmt_start_pid", strconv.Itoa(format.PMTPID))
+	}
+	if offset >= 0 {
+		// Continue the timeline of the track instead of restarting at 0
+		args = append(args, "-output_ts_offset", strconv.FormatFloat(offset, 'f', 6, 64), "-muxdelay", "0", "-muxpreload", "0")
+	}
+	args = append(args, "-t", duration, "-f", "mpegts", "-y", file.Name())
+
+	result, err := exec.Command(ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg filler generation failed: %w\nOutput: %s", err, string(result))
+	}
+	return os.ReadFile(file.Name())
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// HeaderRule sets a header on requests matching a host glob and request class.
+// Rules are applied in order after the global -header values, so later rules
+// win. An empty value removes the header.
+type HeaderRule struct {
+	Host  string       `json:"host,omitempty"`  // Host glob such as "*.example.com", empty matches all hosts
+	Class RequestClass `json:"class,omitempty"` // Request class, empty matches all classes
+	Name  string       `json:"name"`
+	Value string       `json:"value"` // May contain {playlist_url}, {playlist_host}, {playlist_origin}, {url} and {host}
+}
+
+var (
+	headerRules   []HeaderRule
+	headerRulesMu sync.RWMutex
+
+	// playlistURL is the top-level playlist URL used for header templates
+	playlistURL string
+)
+
+// SetHeaderRules sets the scoped header rules
+func SetHeaderRules(rules []HeaderRule) {
+	headerRulesMu.Lock()
+	defer headerRulesMu.Unlock()
+	headerRules = rules
+}
+
+// SetPlaylistURL sets the playlist URL used by header templates
+func SetPlaylistURL(rawURL string) {
+	headerRulesMu.Lock()
+	defer headerRulesMu.Unlock()
+	playlistURL = rawURL
+}
+
+// matches reports whether the rule applies to a request
+func (r HeaderRule) matches(host string, class RequestClass) bool {
+	if r.Class != "" && r.Class != class {
+		return false
+	}
+	if r.Host == "" {
+		return true
+	}
+	matched, err := path.Match(strings.ToLower(r.Host), strings.ToLower(host))
+	return err == nil && matched
+}
+
+// expandHeaderTemplate replaces template placeholders in a header value
+func expandHeaderTemplate(value string, requestURL *url.URL) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+
+	var playlistHost, playlistOrigin string
+	if parsed, err := url.Parse(playlistURL); err == nil {
+		playlistHost = parsed.Host
+		playlistOrigin = parsed.Scheme + "://" + parsed.Host
+	}
+
+	return strings.NewReplacer(
+		"{playlist_url}", playlistURL,
+		"{playlist_host}", playlistHost,
+		"{playlist_origin}", playlistOrigin,
+		"{url}", requestURL.String(),
+		"{host}", requestURL.Host,
+	).Replace(value)
+}
+
+// applyHeaders sets the global custom headers and matching header rules on a request
+func applyHeaders(req *http.Request, class RequestClass) {
+	customHeadersMu.RLock()
+	for key, value := range customHeaders {
+		req.Header.Set(key, expandHeaderTemplate(value, req.URL))
+	}
+	customHeadersMu.RUnlock()
+
+	headerRulesMu.RLock()
+	defer headerRulesMu.RUnlock()
+
+	host := req.URL.Hostname()
+	for _, rule := range headerRules {
+		if !rule.matches(host, class) {
+			continue
+		}
+		if rule.Value == "" {
+			req.Header.Del(rule.Name)
+		} else {
+			req.Header.Set(rule.Name, expandHeaderTemplate(rule.Value, req.URL))
+		}
+	}
+}
+
+// applyRedirectHeaders sets the custom headers and header rules again on a
+// redirected request, so rules scoped to the original host are dropped and
+// templates name the new URL. Credentials Go removed for another host are
+// only set again by rules scoped to that host.
+func applyRedirectHeaders(req *http.Request, class RequestClass) {
+	kept := func(name string) bool {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Www-Authenticate", "Cookie", "Cookie2":
+			return req.Header.Get(name) != ""
+		}
+		return true
+	}
+	allowed := make(map[string]bool)
+	for _, name := range customHeaderNames() {
+		allowed[http.CanonicalHeaderKey(name)] = kept(name)
+		req.Header.Del(name)
+	}
+
+	customHeadersMu.RLock()
+	for key, value := range customHeaders {
+		if allowed[http.CanonicalHeaderKey(key)] {
+			req.Header.Set(key, expandHeaderTemplate(value, req.URL))
+		}
+	}
+	customHeadersMu.RUnlock()
+
+	headerRulesMu.RLock()
+	defer headerRulesMu.RUnlock()
+
+	host := req.URL.Hostname()
+	for _, rule := range headerRules {
+		if !rule.matches(host, class) || (rule.Host == "" && !allowed[http.CanonicalHeaderKey(rule.Name)]) {
+			continue
+		}
+		if rule.Value == "" {
+			req.Header.Del(rule.Name)
+		} else {
+			req.Header.Set(rule.Name, expandHeaderTemplate(rule.Value, req.URL))
+		}
+	}
+}
+
+// applyHostRules applies only the header rules scoped to a host glob that
+// matches the request, used after a redirect to another host
+func applyHostRules(req *http.Request, class RequestClass) {
+	headerRulesMu.RLock()
+	defer headerRulesMu.RUnlock()
+
+	host := req.URL.Hostname()
+	for _, rule := range headerRules {
+		if rule.Host == "" || !rule.matches(host, class) {
+			continue
+		}
+		if rule.Value == "" {
+			req.Header.Del(rule.Name)
+		} else {
+			req.Header.Set(rule.Name, expandHeaderTemplate(rule.Value, req.URL))
+		}
+	}
+}
+
+// customHeaderNames returns the names of all headers set by -header values
+// and header rules
+func customHeaderNames() []string {
+	var names []string
+	customHeadersMu.RLock()
+	for key := range customHeaders {
+		names = append(names, key)
+	}
+	customHeadersMu.RUnlock()
+
+	headerRulesMu.RLock()
+	for _, rule := range headerRules {
+		names = append(names, rule.Name)
+	}
+	headerRulesMu.RUnlock()
+	return names
+}
+
+// parseHeaderRule parses a -header-rule value in format "scope|Key:Value",
+// where scope is a comma-separated list of host=<glob> and class=<class>
+func parseHeaderRule(spec string) (HeaderRule, error) {
+	var rule HeaderRule
+
+	parts := strings.SplitN(spec, "|", 2)
+	if len(parts) != 2 {
+		return rule, fmt.Errorf("invalid header rule %q (expected 'host=<glob>,class=<class>|Key:Value')", spec)
+	}
+
+	for _, field := range strings.Split(parts[0], ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 {
+			return rule, fmt.Errorf("invalid header rule scope %q", field)
+		}
+		switch strings.TrimSpace(keyValue[0]) {
+		case "host":
+			rule.Host = strings.TrimSpace(keyValue[1])
+		case "class":
+			class, err := parseRequestClass(keyValue[1])
+			if err != nil {
+				return rule, err
+			}
+			rule.Class = class
+		default:
+			return rule, fmt.Errorf("unknown header rule scope %q (expected host or class)", keyValue[0])
+		}
+	}
+
+	header := strings.SplitN(parts[1], ":", 2)
+	if len(header) != 2 || strings.TrimSpace(header[0]) == "" {
+		return rule, fmt.Errorf("invalid header in rule %q (expected Key:Value)", spec)
+	}
+	rule.Name = strings.TrimSpace(header[0])
+	rule.Value = strings.TrimSpace(header[1])
+
+	return rule, nil
+}
+
+// LoadHeaderRules reads header rules from a JSON file containing an array of
+// objects with host, class, name and value fields
+func LoadHeaderRules(filePath string) ([]HeaderRule, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header config: %w", err)
+	}
+
+	var rules []HeaderRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse header config: %w", err)
+	}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("header config rule %d has no name", i+1)
+		}
+		if rule.Class != "" {
+			class, err := parseRequestClass(string(rule.Class))
+			if err != nil {
+				return nil, fmt.Errorf("header config rule %d: %w", i+1, err)
+			}
+			rules[i].Class = class
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	// streamTypeMetadata is the PMT stream type of ID3 timed metadata
+	// carried in PES packets
+	streamTypeMetadata = 0x15
+
+	// ptsWrap is the modulus of the 33-bit 90 kHz presentation timestamps
+	ptsWrap = 1 << 33
+
+	// transportStreamTimestampOwner is the PRIV owner of the MPEG-TS
+	// timestamp of packed audio segments
+	transportStreamTimestampOwner = "com.apple.streaming.transportStreamTimestamp"
+)
+
+// ID3Frame is a frame of an ID3v2 tag
+type ID3Frame struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"` // TXXX description
+	Owner       string `json:"owner,omitempty"`       // PRIV owner identifier
+	Value       string `json:"value"`                 // Text, or hex for binary data
+}
+
+// ID3Cue is an ID3 tag carried in the timed metadata stream of a segment, or
+// in front of a packed audio segment
+type ID3Cue struct {
+	PTS             int64     // 90 kHz presentation timestamp, -1 if unknown
+	Offset          float64   // Seconds from the start of the track
+	ProgramDateTime time.Time // Wall-clock time, zero without #EXT-X-PROGRAM-DATE-TIME
+	Sequence        int64     // Media sequence number of the segment
+	Frames          []ID3Frame
+}
+
+// Title returns the text of the cue's TIT2 frame, or of its first TXXX frame
+func (c ID3Cue) Title() string {
+	var fallback string
+	for _, frame := range c.Frames {
+		switch frame.ID {
+		case "TIT2":
+			return frame.Value
+		case "TXXX":
+			if fallback == "" {
+				fallback = frame.Value
+			}
+		}
+	}
+	return fallback
+}
+
+// tsMetadata is what demuxTS finds in an MPEG-TS segment
+type tsMetadata struct {
+	FirstPTS int64      // Earliest PTS of any elementary stream, -1 if none
+	Tags     []pesTag   // PES packets of the timed metadata streams
+	PMTPID   int        // PID of the first program map table, 0 if none
+	Streams  []tsStream // Elementary streams of that program map table
+}
+
+// tsStream is an elementary stream listed in a program map table
+type tsStream struct {
+	Type byte
+	PID  int
+}
+
+// pesTag is the payload of a metadata PES packet with its timestamp
+type pesTag struct {
+	PTS     int64
+	Payload []byte
+}
+
+// demuxTS reads the PAT and PMT of an MPEG-TS segment and collects the PES
+// packets of its timed metadata streams, along with the earliest timestamp of
+// the segment to place them against and the streams of the program
+func demuxTS(data []byte) tsMetadata {
+	result := tsMetadata{FirstPTS: -1}
+	pmtPIDs := make(map[int]bool)
+	metadataPIDs := make(map[int]bool)
+	pes := make(map[int][]byte) // PES packets being assembled, by PID
+
+	finish := func(pid int) {
+		packet := pes[pid]
+		delete(pes, pid)
+		pts, payload, ok := parsePES(packet)
+		if !ok {
+			return
+		}
+		if pts >= 0 && (result.FirstPTS < 0 || ptsBefore(pts, result.FirstPTS)) && !metadataPIDs[pid] {
+			result.FirstPTS = pts
+		}
+		if metadataPIDs[pid] {
+			result.Tags = append(result.Tags, pesTag{PTS: pts, Payload: payload})
+		}
+	}
+
+	for offset := 0; offset+tsPacketSize <= len(data); offset += tsPacketSize {
+		packet := data[offset : offset+tsPacketSize]
+		if packet[0] != tsSyncByte {
+			// Resynchronise on the next sync byte
+			next := bytes.IndexByte(data[offset+1:], tsSyncByte)
+			if next == -1 {
+				break
+			}
+			offset += next + 1 - tsPacketSize
+			continue
+		}
+
+		unitStart := packet[1]&0x40 != 0
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		adaptation := (packet[3] >> 4) & 0x3
+		payload := packet[4:]
+		if adaptation&0x2 != 0 {
+			if int(payload[0])+1 > len(payload) {
+				continue
+			}
+			payload = payload[payload[0]+1:]
+		}
+		if adaptation&0x1 == 0 {
+			continue
+		}
+
+		switch {
+		case pid == 0:
+			for _, pmt := range parsePAT(payload, unitStart) {
+				pmtPIDs[pmt] = true
+			}
+		case pmtPIDs[pid]:
+			streams := parsePMT(payload, unitStart, metadataPIDs)
+			if result.PMTPID == 0 && len(streams) > 0 {
+				result.PMTPID = pid
+				result.Streams = streams
+			}
+		default:
+			if unitStart {
+				if _, ok := pes[pid]; ok {
+					finish(pid)
+				}
+				pes[pid] = append([]byte(nil), payload...)
+			} else if _, ok := pes[pid]; ok {
+				pes[pid] = append(pes[pid], payload...)
+			}
+		}
+	}
+	for pid := range pes {
+		finish(pid)
+	}
+	return result
+}
+
+// psiSection returns the section of a PSI packet payload
+func psiSection(payload []byte, unitStart bool) []byte {
+	if !unitStart || len(payload) == 0 || int(payload[0])+1 >= len(payload) {
+		return nil
+	}
+	section := payload[payload[0]+1:]
+	if len(section) < 3 {
+		return nil
+	}
+	length := int(section[1]&0x0f)<<8 | int(section[2])
+	if 3+length > len(section) {
+		return section
+	}
+	return section[:3+length]
+}
+
+// parsePAT returns the PMT PIDs listed in a program association table
+func parsePAT(payload []byte, unitStart bool) []int {
+	section := psiSection(payload, unitStart)
+	if len(section) < 12 {
+		return nil
+	}
+	var pids []int
+	// Program entries follow the 8-byte header and precede the 4-byte CRC
+	for i := 8; i+4 <= len(section)-4; i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			pids = append(pids, int(section[i+2]&0x1f)<<8|int(section[i+3]))
+		}
+	}
+	return pids
+}
+
+// parsePMT returns the streams of a program map table and adds the PIDs of
+// its timed metadata streams to metadataPIDs
+func parsePMT(payload []byte, unitStart bool, metadataPIDs map[int]bool) []tsStream {
+	section := psiSection(payload, unitStart)
+	if len(section) < 16 {
+		return nil
+	}
+	var streams []tsStream
+	programInfo := int(section[10]&0x0f)<<8 | int(section[11])
+	for i := 12 + programInfo; i+5 <= len(section)-4; {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		esInfo := int(section[i+3]&0x0f)<<8 | int(section[i+4])
+		if streamType == streamTypeMetadata {
+			metadataPIDs[pid] = true
+		}
+		streams = append(streams, tsStream{Type: streamType, PID: pid})
+		i += 5 + esInfo
+	}
+	return streams
+}
+
+// parsePES returns the PTS (-1 if absent) and payload of a PES packet
+func parsePES(packet []byte) (int64, []byte, bool) {
+	if len(packet) < 9 || packet[0] != 0 || packet[1] != 0 || packet[2] != 1 {
+		return 0, nil, false
+	}
+	headerLength := int(packet[8])
+	if 9+headerLength > len(packet) {
+		return 0, nil, false
+	}
+	pts := int64(-1)
+	if packet[7]&0x80 != 0 && headerLength >= 5 {
+		p := packet[9:14]
+		pts = int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	}
+	payload := packet[9+headerLength:]
+	if length := int(binary.BigEndian.Uint16(packet[4:6])); length > 0 {
+		if 6+length < 9+headerLength {
+			// The packet is shorter than its own header
+			return 0, nil, false
+		}
+		if 6+length <= len(packet) {
+			payload = packet[9+headerLength : 6+length]
+		}
+	}
+	return pts, payload, true
+}
+
+// ptsBefore reports whether PTS a comes before b, allowing for wraparound
+func ptsBefore(a, b int64) bool {
+	return ptsDiff(a, b) < 0
+}
+
+// ptsDiff returns a-b in 90 kHz ticks, allowing for wraparound
+func ptsDiff(a, b int64) int64 {
+	diff := (a - b) % ptsWrap
+	if diff > ptsWrap/2 {
+		diff -= ptsWrap
+	} else if diff < -ptsWrap/2 {
+		diff += ptsWrap
+	}
+	return diff
+}
+
+// parseID3Tags parses the ID3v2 tags at the start of data, which may be
+// several tags back to back. It returns the frames and the number of bytes
+// the tags take up.
+func parseID3Tags(data []byte) ([]ID3Frame, int) {
+	var frames []ID3Frame
+	consumed := 0
+	for len(data)-consumed >= 10 && string(data[consumed:consumed+3]) == "ID3" {
+		tag := data[consumed:]
+		version := tag[3]
+		size := syncsafe(tag[6:10])
+		end := 10 + size
+		if tag[5]&0x10 != 0 {
+			end += 10 // Footer
+		}
+		if end > len(tag) {
+			end = len(tag)
+		}
+
+		body := tag[10:min(10+size, len(tag))]
+		if tag[5]&0x40 != 0 && len(body) >= 4 {
+			// Skip the extended header
+			extended := int(binary.BigEndian.Uint32(body[:4]))
+			if version == 4 {
+				extended = syncsafe(body[:4])
+			} else {
+				extended += 4
+			}
+			if extended < 0 || extended > len(body) {
+				extended = len(body)
+			}
+			body = body[extended:]
+		}
+		frames = append(frames, parseID3Frames(body, version)...)
+		consumed += end
+	}
+	return frames, consumed
+}
+
+// parseID3Frames parses the frames of an ID3v2.3 or v2.4 tag body
+func parseID3Frames(body []byte, version byte) []ID3Frame {
+	var frames []ID3Frame
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if version == 4 {
+			size = syncsafe(body[4:8])
+		}
+		if size < 0 || size > len(body)-10 {
+			// Truncated, or a size that would overflow on 32-bit platforms
+			break
+		}
+		content := body[10 : 10+size]
+		body = body[10+size:]
+
+		frame := ID3Frame{ID: id}
+		switch {
+		case id == "TXXX" && len(content) > 0:
+			description, value := splitID3Text(content[1:], content[0])
+			frame.Description = description
+			frame.Value = value
+		case strings.HasPrefix(id, "T") && len(content) > 0:
+			frame.Value = decodeID3Text(content[1:], content[0])
+		case id == "PRIV":
+			owner, data, _ := bytes.Cut(content, []byte{0})
+			frame.Owner = string(owner)
+			if frame.Owner == transportStreamTimestampOwner && len(data) == 8 {
+				frame.Value = strconv.FormatUint(binary.BigEndian.Uint64(data)&(ptsWrap-1), 10)
+			} else {
+				frame.Value = hex.EncodeToString(data)
+			}
+		default:
+			frame.Value = hex.EncodeToString(content)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// syncsafe decodes a 28-bit syncsafe integer
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// splitID3Text splits the description and value of a TXXX frame
+func splitID3Text(data []byte, encoding byte) (string, string) {
+	terminator := []byte{0}
+	if encoding == 1 || encoding == 2 {
+		// UTF-16 strings end with a 16-bit NUL on a character boundary
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return decodeID3Text(data[:i], encoding), decodeID3Text(data[i+2:], encoding)
+			}
+		}
+		return decodeID3Text(data, encoding), ""
+	}
+	description, value, _ := bytes.Cut(data, terminator)
+	return decodeID3Text(description, encoding), decodeID3Text(value, encoding)
+}
+
+// decodeID3Text decodes ID3 text in ISO-8859-1 (0), UTF-16 with BOM (1),
+// UTF-16BE (2) or UTF-8 (3)
+func decodeID3Text(data []byte, encoding byte) string {
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			bigEndian, data = false, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			bigEndian, data = true, data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+			} else {
+				units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	case 3:
+		return strings.TrimRight(string(data), "\x00")
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return strings.TrimRight(string(runes), "\x00")
+}
+
+// transportStreamTimestamp returns the PTS carried by a PRIV
+// transportStreamTimestamp frame, or -1
+func transportStreamTimestamp(frames []ID3Frame) int64 {
+	for _, frame := range frames {
+		if frame.ID == "PRIV" && frame.Owner == transportStreamTimestampOwner {
+			if pts, err := strconv.ParseInt(frame.Value, 10, 64); err == nil {
+				return pts
+			}
+		}
+	}
+	return -1
+}
+
+// SegmentID3Cues returns the ID3 tags of a segment starting start seconds into
+// its track: the timed metadata stream of an MPEG-TS segment, placed at their
+// PTS relative to the earliest timestamp of the segment, or the tags in front
+// of a packed audio segment, placed at its start
+func SegmentID3Cues(data []byte, segment Segment, start float64) []ID3Cue {
+	var cues []ID3Cue
+	add := func(pts int64, offset float64, frames []ID3Frame) {
+		cue := ID3Cue{PTS: pts, Offset: start + offset, Sequence: segment.Sequence, Frames: frames}
+		if !segment.ProgramDateTime.IsZero() {
+			cue.ProgramDateTime = segment.ProgramDateTime.Add(durationOf(offset))
+		}
+		cues = append(cues, cue)
+	}
+
+	if len(data) > 0 && data[0] == tsSyncByte {
+		metadata := demuxTS(data)
+		for _, tag := range metadata.Tags {
+			frames, _ := parseID3Tags(tag.Payload)
+			if len(frames) == 0 {
+				continue
+			}
+			offset := 0.0
+			if tag.PTS >= 0 && metadata.FirstPTS >= 0 {
+				offset = float64(ptsDiff(tag.PTS, metadata.FirstPTS)) / 90000
+			}
+			add(tag.PTS, offset, frames)
+		}
+		return cues
+	}
+
+	if frames, _ := parseID3Tags(data); len(frames) > 0 {
+		add(transportStreamTimestamp(frames), 0, frames)
+	}
+	return cues
+}
+
+// ExtractID3Cues collects the ID3 timed metadata of a downloaded MPEG-TS or
+// packed audio track
+func ExtractID3Cues(track *Track) []ID3Cue {
+	if track.Playlist.IsFragmented {
+		return nil
+	}
+
+	var cues []ID3Cue
+	position := 0.0
+	for i, segment := range track.Segments {
+		start := position
+		position += segment.Duration
+		if i >= len(track.Results) || track.Results[i].Missing {
+			continue
+		}
+
+		data := track.Results[i].Data
+		if track.Results[i].FilePath != "" {
+			var err error
+			if data, err = os.ReadFile(track.Results[i].FilePath); err != nil {
+				continue
+			}
+		}
+		cues = append(cues, SegmentID3Cues(data, segment, start)...)
+	}
+	return cues
+}
+
+// TimedMetadataWriter writes ID3 cues as JSON lines, one cue per line
+type TimedMetadataWriter struct {
+	Path  string
+	Count int // Cues written
+
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// id3Record is the JSON line written for a cue
+type id3Record struct {
+	Track           string     `json:"track"`
+	Sequence        int64      `json:"sequence"`
+	PTS             *int64     `json:"pts"`  // 90 kHz, null if unknown
+	Time            float64    `json:"time"` // Seconds from the start of the track
+	ProgramDateTime string     `json:"program_date_time,omitempty"`
+	Frames          []ID3Frame `json:"frames"`
+}
+
+// NewTimedMetadataWriter creates the JSON lines file
+func NewTimedMetadataWriter(path string) (*TimedMetadataWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create timed metadata file: %w", err)
+	}
+	return &TimedMetadataWriter{Path: path, file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// Write appends the cues of a track
+func (w *TimedMetadataWriter) Write(track string, cues []ID3Cue) error {
+	for _, cue := range cues {
+		record := id3Record{
+			Track:    track,
+			Sequence: cue.Sequence,
+			Time:     math.Round(cue.Offset*1000) / 1000,
+			Frames:   cue.Frames,
+		}
+		if cue.PTS >= 0 {
+			pts := cue.PTS
+			record.PTS = &pts
+		}
+		if !cue.ProgramDateTime.IsZero() {
+			record.ProgramDateTime = cue.ProgramDateTime.UTC().Format("2006-01-02T15:04:05.000Z")
+		}
+		if err := w.encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to write timed metadata: %w", err)
+		}
+		w.Count++
+	}
+	return nil
+}
+
+// Close closes the file
+func (w *TimedMetadataWriter) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// tsPacket builds a 188-byte TS packet, padding short payloads with an
+// adaptation field of stuffing bytes
+func tsPacket(pid int, unitStart bool, payload []byte) []byte {
+	packet := []byte{tsSyncByte, byte(pid>>8) & 0x1f, byte(pid), 0x10}
+	if unitStart {
+		packet[1] |= 0x40
+	}
+	if stuffing := tsPacketSize - 4 - len(payload); stuffing > 0 {
+		packet[3] = 0x30
+		adaptation := make([]byte, stuffing)
+		adaptation[0] = byte(stuffing - 1)
+		for i := 1; i < stuffing; i++ {
+			adaptation[i] = 0xff
+		}
+		if stuffing > 1 {
+			adaptation[1] = 0x00 // Adaptation flags
+		}
+		packet = append(packet, adaptation...)
+	}
+	return append(packet, payload...)
+}
+
+// tsPES splits a PES packet across as many TS packets as it needs
+func tsPES(pid int, pes []byte) []byte {
+	var out []byte
+	for first := true; len(pes) > 0; first = false {
+		n := min(len(pes), tsPacketSize-4)
+		out = append(out, tsPacket(pid, first, pes[:n])...)
+		pes = pes[n:]
+	}
+	return out
+}
+
+// patPayload is a PAT listing a single program with its PMT on pmtPID
+func patPayload(pmtPID int) []byte {
+	return []byte{
+		0x00,             // Pointer field
+		0x00, 0xb0, 0x0d, // Table ID, section length 13
+		0x00, 0x01, 0xc1, 0x00, 0x00, // Stream ID, version, section numbers
+		0x00, 0x01, 0xe0 | byte(pmtPID>>8), byte(pmtPID), // Program 1
+		0x00, 0x00, 0x00, 0x00, // CRC
+	}
+}
+
+// pmtPayload is a PMT listing the given stream types and PIDs
+func pmtPayload(streams ...[2]int) []byte {
+	section := []byte{0x02, 0xb0, byte(13 + 5*len(streams)), 0x00, 0x01, 0xc1, 0x00, 0x00, 0xe1, 0x00, 0xf0, 0x00}
+	for _, stream := range streams {
+		section = append(section, byte(stream[0]), 0xe0|byte(stream[1]>>8), byte(stream[1]), 0xf0, 0x00)
+	}
+	section = append(section, 0x00, 0x00, 0x00, 0x00)
+	return append([]byte{0x00}, section...)
+}
+
+// pesPacket builds a PES packet with a PTS, or none if pts is negative
+func pesPacket(streamID byte, pts int64, payload []byte) []byte {
+	header := []byte{0x80, 0x00, 0x00}
+	if pts >= 0 {
+		header = []byte{0x80, 0x80, 0x05,
+			0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 0x01, byte(pts >> 7), byte(pts<<1) | 0x01}
+	}
+	packet := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00}
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(header)+len(payload)))
+	packet = append(packet, header...)
+	return append(packet, payload...)
+}
+
+// id3Frame builds an ID3v2.3 or v2.4 frame
+func id3Frame(version byte, id string, content []byte) []byte {
+	frame := append([]byte(id), 0, 0, 0, 0, 0, 0)
+	if version == 4 {
+		copy(frame[4:8], syncsafeBytes(len(content)))
+	} else {
+		binary.BigEndian.PutUint32(frame[4:8], uint32(len(content)))
+	}
+	return append(frame, content...)
+}
+
+// id3Tag builds an ID3v2 tag around the given body
+func id3Tag(version, flags byte, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	tag := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafeBytes(len(data))...)
+	tag = append(tag, data...)
+	if flags&0x10 != 0 {
+		tag = append(tag, '3', 'D', 'I', version, 0, flags)
+		tag = append(tag, syncsafeBytes(len(data))...)
+	}
+	return tag
+}
+
+func syncsafeBytes(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+func TestDemuxTS(t *testing.T) {
+	const (
+		pmtPID   = 0x1000
+		audioPID = 0x101
+		id3PID   = 0x102
+	)
+	tag := id3Tag(4, 0, id3Frame(4, "TIT2", []byte("\x03Chapter 1")))
+	large := id3Tag(4, 0, id3Frame(4, "TXXX", append([]byte("\x03note\x00"), bytes.Repeat([]byte("x"), 400)...)))
+	program := append(tsPacket(0, true, patPayload(pmtPID)),
+		tsPacket(pmtPID, true, pmtPayload([2]int{0x0f, audioPID}, [2]int{streamTypeMetadata, id3PID}))...)
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	badPES := pesPacket(0xbd, 900000, tag)
+	binary.BigEndian.PutUint16(badPES[4:], 2) // Shorter than its own header
+
+	badAdaptation := tsPacket(audioPID, true, pesPacket(0xc0, 1000, nil))
+	badAdaptation[4] = 0xff
+
+	tests := []struct {
+		name     string
+		data     []byte
+		firstPTS int64
+		tags     []pesTag
+		program  bool // Whether the PAT and PMT come first
+	}{
+		{
+			name:     "metadata after audio",
+			data:     join(program, tsPES(audioPID, pesPacket(0xc0, 900000, []byte{1, 2, 3})), tsPES(id3PID, pesPacket(0xbd, 990000, tag))),
+			program:  true,
+			firstPTS: 900000,
+			tags:     []pesTag{{PTS: 990000, Payload: tag}},
+		},
+		{
+			name:     "metadata spanning packets",
+			data:     join(program, tsPES(id3PID, pesPacket(0xbd, 180000, large)), tsPES(audioPID, pesPacket(0xc0, 90000, nil))),
+			program:  true,
+			firstPTS: 90000,
+			tags:     []pesTag{{PTS: 180000, Payload: large}},
+		},
+		{
+			name:     "metadata without PTS",
+			data:     join(program, tsPES(id3PID, pesPacket(0xbd, -1, tag))),
+			program:  true,
+			firstPTS: -1,
+			tags:     []pesTag{{PTS: -1, Payload: tag}},
+		},
+		{
+			name:     "earliest PTS across wraparound",
+			data:     join(program, tsPES(audioPID, pesPacket(0xc0, 90000, nil)), tsPES(audioPID, pesPacket(0xc0, ptsWrap-90000, nil))),
+			program:  true,
+			firstPTS: ptsWrap - 90000,
+		},
+		{
+			name:     "no PMT",
+			data:     join(tsPES(id3PID, pesPacket(0xbd, 990000, tag))),
+			firstPTS: 990000,
+		},
+		{
+			name:     "resync after garbage",
+			data:     join([]byte{0x00, 0x01, 0x02}, program, tsPES(id3PID, pesPacket(0xbd, 990000, tag))),
+			program:  true,
+			firstPTS: -1,
+			tags:     []pesTag{{PTS: 990000, Payload: tag}},
+		},
+		{
+			name:     "truncated packet",
+			data:     join(program, tsPES(audioPID, pesPacket(0xc0, 900000, nil)), tsPES(id3PID, pesPacket(0xbd, 990000, large))[:tsPacketSize+50]),
+			program:  true,
+			firstPTS: 900000,
+			tags:     []pesTag{{PTS: 990000, Payload: tsPES(id3PID, pesPacket(0xbd, 990000, large))[4+14 : tsPacketSize]}},
+		},
+		{
+			name:     "PES length shorter than header",
+			data:     join(program, tsPES(id3PID, badPES)),
+			program:  true,
+			firstPTS: -1,
+		},
+		{
+			name:     "oversized adaptation field",
+			data:     join(program, badAdaptation),
+			program:  true,
+			firstPTS: -1,
+		},
+		{
+			name:     "empty",
+			firstPTS: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := demuxTS(tt.data)
+			if got.FirstPTS != tt.firstPTS {
+				t.Errorf("FirstPTS = %d, want %d", got.FirstPTS, tt.firstPTS)
+			}
+			if !reflect.DeepEqual(got.Tags, tt.tags) {
+				t.Errorf("Tags = %v, want %v", got.Tags, tt.tags)
+			}
+			var pid int
+			var streams []tsStream
+			if tt.program {
+				pid = pmtPID
+				streams = []tsStream{{Type: 0x0f, PID: audioPID}, {Type: streamTypeMetadata, PID: id3PID}}
+			}
+			if got.PMTPID != pid || !reflect.DeepEqual(got.Streams, streams) {
+				t.Errorf("PMT %#x %v, want %#x %v", got.PMTPID, got.Streams, pid, streams)
+			}
+		})
+	}
+}
+
+func TestParseID3Tags(t *testing.T) {
+	title := []ID3Frame{{ID: "TIT2", Value: "Chapter 1"}}
+	v3 := id3Tag(3, 0, id3Frame(3, "TIT2", []byte("\x00Chapter 1")))
+
+	// A frame of 200 bytes has a different size as a syncsafe integer
+	long := string(bytes.Repeat([]byte("a"), 199))
+	v4 := id3Tag(4, 0, id3Frame(4, "TIT2", append([]byte{3}, long...)))
+	footer := id3Tag(4, 0x10, id3Frame(4, "TIT2", []byte("\x03Chapter 1")))
+
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, 1<<33|123456) // Bits above 33 are ignored
+	priv := id3Tag(4, 0, id3Frame(4, "PRIV", append([]byte(transportStreamTimestampOwner+"\x00"), timestamp...)))
+
+	extended := id3Tag(3, 0x40, []byte{0, 0, 0, 6, 0, 0, 0, 0, 0, 0}, id3Frame(3, "TIT2", []byte("\x00Chapter 1")))
+
+	oversizedFrame := id3Tag(3, 0, []byte("TIT2\xff\xff\xff\xff\x00\x00\x00Chapter 1"))
+	oversizedTag := append([]byte("ID3\x04\x00\x00\x7f\x7f\x7f\x7f"), id3Frame(4, "TIT2", []byte("\x03Chapter 1"))...)
+	oversizedExtended := id3Tag(4, 0x40, []byte{0x7f, 0x7f, 0x7f, 0x7f}, id3Frame(4, "TIT2", []byte("\x03Chapter 1")))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		frames   []ID3Frame
+		consumed int
+	}{
+		{name: "v2.3", data: v3, frames: title, consumed: len(v3)},
+		{name: "v2.4 syncsafe frame size", data: v4, frames: []ID3Frame{{ID: "TIT2", Value: long}}, consumed: len(v4)},
+		{name: "v2.4 footer", data: footer, frames: title, consumed: len(footer)},
+		{name: "v2.3 extended header", data: extended, frames: title, consumed: len(extended)},
+		{name: "transport stream timestamp", data: priv, frames: []ID3Frame{{ID: "PRIV", Owner: transportStreamTimestampOwner, Value: "123456"}}, consumed: len(priv)},
+		{name: "back to back", data: append(append([]byte(nil), v3...), v3...), frames: append(title, title...), consumed: 2 * len(v3)},
+		{name: "followed by audio", data: append(append([]byte(nil), v3...), 0xff, 0xf1, 0x50), frames: title, consumed: len(v3)},
+		{name: "padding", data: id3Tag(3, 0, id3Frame(3, "TIT2", []byte("\x00Chapter 1")), make([]byte, 32)), frames: title, consumed: len(v3) + 32},
+		{name: "truncated frame", data: v3[:len(v3)-2], consumed: len(v3) - 2},
+		{name: "truncated header", data: v3[:8]},
+		{name: "oversized frame size", data: oversizedFrame, consumed: len(oversizedFrame)},
+		{name: "oversized tag size", data: oversizedTag, frames: title, consumed: len(oversizedTag)},
+		{name: "oversized extended header", data: oversizedExtended, consumed: len(oversizedExtended)},
+		{name: "not ID3", data: []byte("\x47\x40\x00\x10 not a tag")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, consumed := parseID3Tags(tt.data)
+			if !reflect.DeepEqual(frames, tt.frames) {
+				t.Errorf("frames = %+v, want %+v", frames, tt.frames)
+			}
+			if consumed != tt.consumed {
+				t.Errorf("consumed = %d, want %d", consumed, tt.consumed)
+			}
+		})
+	}
+}
+
+func TestParseID3Frames(t *testing.T) {
+	utf16LE := func(s string) []byte {
+		var b []byte
+		for _, r := range s {
+			b = append(b, byte(r), byte(r>>8))
+		}
+		return b
+	}
+	utf16BE := func(s string) []byte {
+		var b []byte
+		for _, r := range s {
+			b = append(b, byte(r>>8), byte(r))
+		}
+		return b
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name    string
+		version byte
+		body    []byte
+		frames  []ID3Frame
+	}{
+		{
+			name:    "ISO-8859-1 text",
+			version: 3,
+			body:    id3Frame(3, "TIT2", []byte("\x00Caf\xe9\x00")),
+			frames:  []ID3Frame{{ID: "TIT2", Value: "Café"}},
+		},
+		{
+			name:    "UTF-16 text with BOM",
+			version: 3,
+			body:    id3Frame(3, "TIT2", join([]byte{1, 0xff, 0xfe}, utf16LE("Ünïcode"), []byte{0, 0})),
+			frames:  []ID3Frame{{ID: "TIT2", Value: "Ünïcode"}},
+		},
+		{
+			name:    "UTF-16 TXXX with BOM on each string",
+			version: 3,
+			body:    id3Frame(3, "TXXX", join([]byte{1, 0xff, 0xfe}, utf16LE("ad"), []byte{0, 0, 0xfe, 0xff}, utf16BE("break"))),
+			frames:  []ID3Frame{{ID: "TXXX", Description: "ad", Value: "break"}},
+		},
+		{
+			// The terminator is the 0x00 0x00 on a character boundary, not
+			// the 0x00 0x00 straddling "Ā" (0x0100) and "a" (0x0061)
+			name:    "UTF-16BE TXXX terminator on a character boundary",
+			version: 4,
+			body:    id3Frame(4, "TXXX", join([]byte{2}, utf16BE("Āa"), []byte{0, 0}, utf16BE("value"))),
+			frames:  []ID3Frame{{ID: "TXXX", Description: "Āa", Value: "value"}},
+		},
+		{
+			name:    "UTF-8 TXXX",
+			version: 4,
+			body:    id3Frame(4, "TXXX", []byte("\x03kind\x00chapter ✓")),
+			frames:  []ID3Frame{{ID: "TXXX", Description: "kind", Value: "chapter ✓"}},
+		},
+		{
+			name:    "TXXX without terminator",
+			version: 4,
+			body:    id3Frame(4, "TXXX", []byte("\x03kind")),
+			frames:  []ID3Frame{{ID: "TXXX", Description: "kind"}},
+		},
+		{
+			name:    "empty text frame",
+			version: 4,
+			body:    id3Frame(4, "TIT2", nil),
+			frames:  []ID3Frame{{ID: "TIT2"}},
+		},
+		{
+			name:    "PRIV",
+			version: 4,
+			body:    id3Frame(4, "PRIV", []byte("owner\x00\x01\x02")),
+			frames:  []ID3Frame{{ID: "PRIV", Owner: "owner", Value: "0102"}},
+		},
+		{
+			name:    "PRIV timestamp of the wrong length",
+			version: 4,
+			body:    id3Frame(4, "PRIV", []byte(transportStreamTimestampOwner+"\x00\x01\x02")),
+			frames:  []ID3Frame{{ID: "PRIV", Owner: transportStreamTimestampOwner, Value: "0102"}},
+		},
+		{
+			name:    "binary frame",
+			version: 3,
+			body:    id3Frame(3, "GEOB", []byte{0xde, 0xad}),
+			frames:  []ID3Frame{{ID: "GEOB", Value: "dead"}},
+		},
+		{
+			name:    "several frames",
+			version: 4,
+			body:    join(id3Frame(4, "TIT2", []byte("\x03One")), id3Frame(4, "TPE1", []byte("\x03Two"))),
+			frames:  []ID3Frame{{ID: "TIT2", Value: "One"}, {ID: "TPE1", Value: "Two"}},
+		},
+		{
+			name:    "truncated frame after a complete one",
+			version: 4,
+			body:    join(id3Frame(4, "TIT2", []byte("\x03One")), id3Frame(4, "TPE1", []byte("\x03Two"))[:12]),
+			frames:  []ID3Frame{{ID: "TIT2", Value: "One"}},
+		},
+		{
+			name:    "truncated frame header",
+			version: 4,
+			body:    []byte("TIT2\x00\x00"),
+		},
+		{
+			name:    "oversized v2.3 size",
+			version: 3,
+			body:    []byte("TIT2\xff\xff\xff\xff\x00\x00\x03One"),
+		},
+		{
+			name:    "oversized v2.4 size",
+			version: 4,
+			body:    []byte("TIT2\x7f\x7f\x7f\x7f\x00\x00\x03One"),
+		},
+		{
+			name:    "padding",
+			version: 4,
+			body:    make([]byte, 20),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := parseID3Frames(tt.body, tt.version)
+			if !reflect.DeepEqual(frames, tt.frames) {
+				t.Errorf("frames = %+v, want %+v", frames, tt.frames)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Kinds of rendition in an -all-variants download
+const (
+	LadderVideo     = "video"
+	LadderAudio     = "audio"
+	LadderSubtitles = "subtitles"
+)
+
+// LadderFile is one rendition of an -all-variants download and the file it
+// is written to
+type LadderFile struct {
+	Track    *Track
+	Kind     string
+	Title    string // Track name in a multi-track MKV
+	Language string
+	Path     string // Set once written
+}
+
+// unsafeLabel matches characters left out of file name labels
+var unsafeLabel = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// LadderFiles parses every variant and audio rendition of a master playlist,
+// and its subtitle renditions, into tracks to download together. Redundant
+// copies of a variant are left out, and audio renditions shared by several
+// variants are downloaded once. The segments of each rendition are cut like
+// those of playlist: ad breaks removed by -skip-ads first, then the clip.
+func LadderFiles(playlist *M3U8Playlist, breaks []AdBreak, clip *ClipWindow, customKey []byte) []*LadderFile {
+	cut := func(rendition *M3U8Playlist) {
+		if len(breaks) > 0 {
+			rendition.Segments = withoutBreaks(rendition.Segments, breaks)
+		}
+		if clip != nil {
+			rendition.Segments, _ = clip.Segments(rendition.Segments)
+		}
+	}
+
+	var files []*LadderFile
+	labels := make(map[string]bool)
+	unique := func(label string) string {
+		label = labelOf(label)
+		if label == "" {
+			label = "default"
+		}
+		name := label
+		for i := 2; labels[name]; i++ {
+			name = fmt.Sprintf("%s_%d", label, i)
+		}
+		labels[name] = true
+		return name
+	}
+
+	variants := playlist.Variants
+	if len(variants) == 0 && playlist.Variant != nil {
+		variants = []Variant{*playlist.Variant}
+	}
+	// Audio-only variants that are also audio renditions are downloaded once,
+	// as the rendition
+	seen := make(map[string]bool)
+	for _, audio := range playlist.AudioRenditions {
+		seen[audio.URL] = true
+	}
+	var kept []Variant
+	for _, variant := range variants {
+		if seen[variant.URL] || len(redundantVariants(kept, variant)) > 0 || containsVariant(kept, variant.URL) {
+			continue
+		}
+		kept = append(kept, variant)
+
+		rendition := playlist
+		if playlist.Variant == nil || variant.URL != playlist.Variant.URL {
+			var err error
+			rendition, err = parseMediaPlaylist(variant.URL, customKey, playlist.Imports)
+			if err != nil {
+				fmt.Printf("Warning: skipping variant %s: %v\n", variant, err)
+				continue
+			}
+			selected := variant
+			rendition.Variant = &selected
+			cut(rendition)
+		}
+
+		kind := LadderVideo
+		if isAudioOnlyVariant(variant) {
+			kind = LadderAudio
+		}
+		label := strings.TrimSpace(variant.Resolution + " " + bandwidthLabel(variant.Bandwidth))
+		files = append(files, &LadderFile{
+			Track: NewTrack(kind+"_"+unique(label), rendition),
+			Kind:  kind,
+			Title: label,
+		})
+	}
+	if len(variants) == 0 {
+		// A media playlist has a single rendition
+		files = append(files, &LadderFile{Track: NewTrack("video", playlist), Kind: LadderVideo})
+	}
+
+	downloaded := make(map[string]bool)
+	for _, audio := range playlist.AudioRenditions {
+		if downloaded[audio.URL] {
+			continue
+		}
+		downloaded[audio.URL] = true
+
+		rendition := playlist.AudioPlaylist
+		if rendition == nil || rendition.URL != audio.URL {
+			var err error
+			rendition, err = parseMediaPlaylist(audio.URL, customKey, playlist.Imports)
+			if err != nil {
+				fmt.Printf("Warning: skipping audio rendition %q: %v\n", audio.Name, err)
+				continue
+			}
+			cut(rendition)
+		}
+
+		label := audio.Language
+		if label == "" {
+			label = audio.Name
+		}
+		if label == "" || labels[labelOf(label)] {
+			label = strings.TrimSpace(label + " " + audio.GroupID)
+		}
+		files = append(files, &LadderFile{
+			Track:    NewTrack(LadderAudio+"_"+unique(label), rendition),
+			Kind:     LadderAudio,
+			Title:    audio.Name,
+			Language: audio.Language,
+		})
+	}
+
+	tracks, subtitles := loadSubtitleTracks(playlist, clip)
+	for i, track := range tracks {
+		files = append(files, &LadderFile{
+			Track:    track,
+			Kind:     LadderSubtitles,
+			Title:    subtitles[i].Name,
+			Language: subtitles[i].Language,
+		})
+	}
+	return files
+}
+
+// withoutDroppedFiles returns the renditions whose track was not dropped
+func withoutDroppedFiles(files []*LadderFile) []*LadderFile {
+	var kept []*LadderFile
+	for _, file := range files {
+		if !file.Track.Dropped() {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// labelOf turns a description into a label for file and track names
+func labelOf(description string) string {
+	return strings.Trim(unsafeLabel.ReplaceAllString(description, "_"), "_")
+}
+
+// containsVariant reports whether a variant with url is in variants
+func containsVariant(variants []Variant, url string) bool {
+	for _, variant := range variants {
+		if variant.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// bandwidthLabel formats a bandwidth for labels, e.g. "2500k"
+func bandwidthLabel(bandwidth int64) string {
+	if bandwidth <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dk", bandwidth/1000)
+}
+
+// WriteLadder writes each downloaded rendition next to output as
+// <base>.<track name>.<ext>, in the format of its segments. MPEG-TS
+// renditions are converted when output is an .mp4 file. When output is an
+// .mkv file the renditions are muxed into it as one multi-track file instead.
+func WriteLadder(files []*LadderFile, output string) error {
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	multiTrack := strings.HasSuffix(output, ".mkv")
+
+	for _, file := range files {
+		track := file.Track
+		name := base + "." + track.Name
+		var err error
+		switch format := trackPackedAudio(track); {
+		case file.Kind == LadderSubtitles:
+			file.Path = name + ".vtt"
+			err = MergeSubtitles(track.Results, file.Path)
+		case track.Playlist.IsFragmented:
+			file.Path = name + ".mp4"
+			if file.Kind == LadderAudio {
+				file.Path = name + ".m4a"
+			}
+			err = MergeSegmentsWithInit(track.Results, track.InitData, file.Path)
+		case format != "":
+			file.Kind = LadderAudio
+			file.Path = name + "." + format
+			err = MergePackedAudio(track.Results, file.Path)
+		default:
+			file.Path = name + ".ts"
+			err = MergeSegments(track.Results, file.Path)
+			if err == nil && !multiTrack && strings.HasSuffix(output, ".mp4") {
+				fmt.Printf("Converting %s to MP4 using ffmpeg...\n", track.Name)
+				if err = convertToMP4(file.Path, name+".mp4"); err == nil {
+					os.Remove(file.Path)
+					file.Path = name + ".mp4"
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", track.Name, err)
+		}
+	}
+
+	if !multiTrack {
+		return nil
+	}
+	fmt.Printf("\nMuxing %d rendition(s) into %s using ffmpeg...\n", len(files), output)
+	if err := muxLadder(files, output); err != nil {
+		return fmt.Errorf("%w\nRenditions kept next to the output", err)
+	}
+	for _, file := range files {
+		os.Remove(file.Path)
+	}
+	return nil
+}
+
+// muxLadder muxes rendition files into one MKV file with ffmpeg, naming each
+// track and tagging its language. Audio muxed into the video variants is only
+// kept when there are no separate audio renditions.
+func muxLadder(files []*LadderFile, output string) error {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	// Audio renditions, unlike variants, have no Variant
+	separateAudio := false
+	for _, file := range files {
+		separateAudio = separateAudio || (file.Kind == LadderAudio && file.Track.Playlist.Variant == nil)
+	}
+
+	var inputs, maps, metadata []string
+	streams := make(map[string]int) // Output streams of each kind so far
+	for i, file := range files {
+		inputs = append(inputs, "-i", file.Path)
+		stream := map[string]string{LadderVideo: "v", LadderAudio: "a", LadderSubtitles: "s"}[file.Kind]
+		maps = append(maps, "-map", fmt.Sprintf("%d:%s", i, stream))
+		if file.Kind == LadderVideo && !separateAudio {
+			maps = append(maps, "-map", fmt.Sprintf("%d:a?", i))
+		}
+
+		// Audio stream numbers are only known when the audio muxed into the
+		// video variants is left out
+		if file.Kind != LadderAudio || separateAudio {
+			specifier := fmt.Sprintf("-metadata:s:%s:%d", stream, streams[stream])
+			if file.Title != "" {
+				metadata = append(metadata, specifier, "title="+file.Title)
+			}
+			if file.Language != "" {
+				metadata = append(metadata, specifier, "language="+file.Language)
+			}
+		}
+		streams[stream]++
+	}
+
+	args := append(inputs, maps...)
+	args = append(args, metadata...)
+	args = append(args, "-c", "copy", "-y", output)
+	result, err := exec.Command(ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg multi-track mux failed: %w\nOutput: %s", err, string(result))
+	}
+	return nil
+}
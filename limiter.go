@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveInitial is the starting parallelism per host in adaptive mode
+	adaptiveInitial = 2
+	// adaptiveWindow is how often throughput is sampled to decide on growth
+	adaptiveWindow = 2 * time.Second
+	// adaptiveMaxErrorRate is the error rate above which parallelism stops growing
+	adaptiveMaxErrorRate = 0.05
+	// adaptiveMinGain is the throughput improvement required to keep growing
+	adaptiveMinGain = 1.05
+)
+
+// hostState tracks in-flight downloads and the adaptive limit of one host
+type hostState struct {
+	inFlight int
+	limit    int // Current limit, 0 means only the global limit applies
+	maxLimit int // Upper bound for adaptive growth
+
+	windowStart   time.Time
+	windowBytes   int64
+	windowOK      int
+	windowErrors  int
+	lastRate      float64
+	cooldownUntil time.Time
+}
+
+// ConcurrencyLimiter bounds in-flight downloads globally and per host. In
+// adaptive mode each host's limit grows while throughput keeps improving and
+// is halved on throttling responses or timeouts.
+type ConcurrencyLimiter struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	maxGlobal  int
+	inFlight   int
+	adaptive   bool
+	hostLimits map[string]int
+	hosts      map[string]*hostState
+}
+
+// NewConcurrencyLimiter creates a limiter allowing maxGlobal downloads at once.
+// hostLimits caps individual hosts; adaptive enables throughput-based tuning.
+func NewConcurrencyLimiter(maxGlobal int, hostLimits map[string]int, adaptive bool) *ConcurrencyLimiter {
+	if maxGlobal < 1 {
+		maxGlobal = 1
+	}
+	l := &ConcurrencyLimiter{
+		maxGlobal:  maxGlobal,
+		adaptive:   adaptive,
+		hostLimits: hostLimits,
+		hosts:      make(map[string]*hostState),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// host returns the state of a host, creating it on first use
+func (l *ConcurrencyLimiter) host(name string) *hostState {
+	state, ok := l.hosts[name]
+	if ok {
+		return state
+	}
+
+	state = &hostState{maxLimit: l.maxGlobal, windowStart: time.Now()}
+	limit, ok := l.hostLimits[name]
+	if !ok {
+		// Allow limits to be given without the port
+		if hostname, _, err := net.SplitHostPort(name); err == nil {
+			limit, ok = l.hostLimits[hostname]
+		}
+	}
+	if ok {
+		state.maxLimit = limit
+		state.limit = limit
+	}
+	if l.adaptive {
+		state.limit = adaptiveInitial
+		if state.limit > state.maxLimit {
+			state.limit = state.maxLimit
+		}
+	}
+	l.hosts[name] = state
+	return state
+}
+
+// AcquireFirst blocks until a download slot is available for any of the
+// hosts, takes it for the first such host in the list and returns its index
+func (l *ConcurrencyLimiter) AcquireFirst(hosts []string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for {
+		if l.inFlight < l.maxGlobal {
+			for i, host := range hosts {
+				state := l.host(host)
+				if state.limit == 0 || state.inFlight < state.limit {
+					l.inFlight++
+					state.inFlight++
+					return i
+				}
+			}
+		}
+		l.cond.Wait()
+	}
+}
+
+// Release frees a download slot for the host
+func (l *ConcurrencyLimiter) Release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.host(host).inFlight--
+	l.cond.Broadcast()
+}
+
+// Observe records the outcome of a single request attempt. It is a no-op
+// unless adaptive mode is enabled.
+func (l *ConcurrencyLimiter) Observe(host string, bytes int, err error) {
+	if !l.adaptive {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state := l.host(host)
+	now := time.Now()
+
+	if err != nil {
+		state.windowErrors++
+		if isThrottled(err) && now.After(state.cooldownUntil) {
+			// Back off quickly, then give the host a window to recover
+			previous := state.limit
+			state.limit = max(1, state.limit/2)
+			state.cooldownUntil = now.Add(adaptiveWindow)
+			state.resetWindow(now)
+			state.lastRate = 0
+			if state.limit != previous {
+				fmt.Printf("\n⚙️  Throttled by %s (%v), concurrency %d → %d\n", host, err, previous, state.limit)
+			}
+			l.cond.Broadcast()
+		}
+		return
+	}
+
+	state.windowBytes += int64(bytes)
+	state.windowOK++
+
+	elapsed := now.Sub(state.windowStart)
+	if elapsed < adaptiveWindow {
+		return
+	}
+
+	// Grow while throughput improves, errors stay low and the host is saturated
+	rate := float64(state.windowBytes) / elapsed.Seconds()
+	errorRate := float64(state.windowErrors) / float64(state.windowOK+state.windowErrors)
+	saturated := state.inFlight >= state.limit
+	if errorRate <= adaptiveMaxErrorRate && saturated && state.limit < state.maxLimit &&
+		(state.lastRate == 0 || rate > state.lastRate*adaptiveMinGain) {
+		state.limit++
+		l.cond.Broadcast()
+	}
+	state.lastRate = rate
+	state.resetWindow(now)
+}
+
+// resetWindow starts a new throughput sampling window
+func (s *hostState) resetWindow(now time.Time) {
+	s.windowStart = now
+	s.windowBytes = 0
+	s.windowOK = 0
+	s.windowErrors = 0
+}
+
+// Limits returns the current per-host limits for reporting
+func (l *ConcurrencyLimiter) Limits() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limits := make(map[string]int, len(l.hosts))
+	for name, state := range l.hosts {
+		limits[name] = state.limit
+	}
+	return limits
+}
+
+// isThrottled reports whether an error indicates the server is overloaded
+// or rate limiting us
+func isThrottled(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == 429 || httpErr.StatusCode >= 500
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// hostOf returns the host part of a URL, used to key per-host limits
+func hostOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Host
+}
+
+// parseHostLimits parses -host-concurrent values in format "host=N"
+func parseHostLimits(specs []string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid host limit %q (expected host=N)", spec)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid host limit %q: limit must be a positive number", spec)
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
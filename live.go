@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxReloadFailures is how many consecutive playlist reloads may fail before
+// a live recording gives up
+const maxReloadFailures = 5
+
+// Part is an LL-HLS partial segment declared by #EXT-X-PART
+type Part struct {
+	URL         string
+	Duration    float64
+	Independent bool   // Starts with an independent frame
+	ByteRange   string // BYTERANGE attribute, parts with byte ranges are not fetched individually
+	Gap         bool
+}
+
+// ServerControl holds the #EXT-X-SERVER-CONTROL attributes
+type ServerControl struct {
+	CanBlockReload bool    // Server holds _HLS_msn/_HLS_part requests until they can be answered
+	CanSkipUntil   float64 // Server can skip segments older than this many seconds from the edge
+	HoldBack       float64 // Minimum distance from the live edge in seconds
+	PartHoldBack   float64 // Minimum distance from the live edge in seconds when playing parts
+}
+
+// PreloadHint is a resource announced by #EXT-X-PRELOAD-HINT before it is available
+type PreloadHint struct {
+	Type string // PART or MAP
+	URL  string
+}
+
+// RenditionReport is the live edge of another rendition from #EXT-X-RENDITION-REPORT
+type RenditionReport struct {
+	URL      string
+	LastMSN  int64
+	LastPart int
+}
+
+// parseServerControl parses an #EXT-X-SERVER-CONTROL tag
+func parseServerControl(line string) ServerControl {
+	attrs := parseAttributes(line)
+	control := ServerControl{CanBlockReload: attrs["CAN-BLOCK-RELOAD"] == "YES"}
+	control.CanSkipUntil, _ = strconv.ParseFloat(attrs["CAN-SKIP-UNTIL"], 64)
+	control.HoldBack, _ = strconv.ParseFloat(attrs["HOLD-BACK"], 64)
+	control.PartHoldBack, _ = strconv.ParseFloat(attrs["PART-HOLD-BACK"], 64)
+	return control
+}
+
+// parsePart parses an #EXT-X-PART tag
+func parsePart(line string, baseURL *url.URL) Part {
+	attrs := parseAttributes(line)
+	part := Part{
+		URL:         resolveURL(baseURL, attrs["URI"]),
+		Independent: attrs["INDEPENDENT"] == "YES",
+		ByteRange:   attrs["BYTERANGE"],
+		Gap:         attrs["GAP"] == "YES",
+	}
+	part.Duration, _ = strconv.ParseFloat(attrs["DURATION"], 64)
+	return part
+}
+
+// parsePreloadHint parses an #EXT-X-PRELOAD-HINT tag
+func parsePreloadHint(line string, baseURL *url.URL) *PreloadHint {
+	attrs := parseAttributes(line)
+	hint := &PreloadHint{Type: attrs["TYPE"], URL: resolveURL(baseURL, attrs["URI"])}
+	// Hints for a byte range of a resource can't be fetched as a whole
+	if attrs["BYTERANGE-START"] != "" || attrs["BYTERANGE-LENGTH"] != "" {
+		hint.URL = ""
+	}
+	return hint
+}
+
+// parseRenditionReport parses an #EXT-X-RENDITION-REPORT tag
+func parseRenditionReport(line string, baseURL *url.URL) RenditionReport {
+	attrs := parseAttributes(line)
+	report := RenditionReport{URL: resolveURL(baseURL, attrs["URI"])}
+	report.LastMSN, _ = strconv.ParseInt(attrs["LAST-MSN"], 10, 64)
+	report.LastPart, _ = strconv.Atoi(attrs["LAST-PART"])
+	return report
+}
+
+// deliveryDirectivesURL adds delivery directives to a playlist URL: _HLS_msn
+// unless msn is negative, _HLS_part unless part is negative, and _HLS_skip
+// when asking for a delta update. The playlist's own query is kept byte for
+// byte, since signed URLs break when it is reordered or re-escaped.
+func deliveryDirectivesURL(playlistURL string, msn int64, part int, skip bool) string {
+	parsed, err := url.Parse(playlistURL)
+	if err != nil {
+		return playlistURL
+	}
+	stripDeliveryDirectives(parsed)
+
+	// The directives follow each other in the order the spec gives them
+	var directives []string
+	if msn >= 0 {
+		directives = append(directives, "_HLS_msn="+strconv.FormatInt(msn, 10))
+		if part >= 0 {
+			directives = append(directives, "_HLS_part="+strconv.Itoa(part))
+		}
+	}
+	if skip {
+		directives = append(directives, "_HLS_skip=YES")
+	}
+	if len(directives) > 0 {
+		if parsed.RawQuery != "" {
+			parsed.RawQuery += "&"
+		}
+		parsed.RawQuery += strings.Join(directives, "&")
+	}
+	return parsed.String()
+}
+
+// stripDeliveryDirectives removes the _HLS_ query parameters from a URL so
+// they are not carried over to the URLs resolved against it. The other
+// parameters are left as they are.
+func stripDeliveryDirectives(parsed *url.URL) {
+	if !strings.Contains(parsed.RawQuery, "_HLS_") {
+		return
+	}
+	var kept []string
+	for _, param := range strings.Split(parsed.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !strings.HasPrefix(name, "_HLS_") {
+			kept = append(kept, param)
+		}
+	}
+	parsed.RawQuery = strings.Join(kept, "&")
+}
+
+// playlistValidators are the cache validators of the last playlist response,
+// sent back on the next request for the same playlist
+type playlistValidators struct {
+	URL          string // Playlist URL without delivery directives
+	ETag         string
+	LastModified string
+}
+
+// withoutDeliveryDirectives returns a playlist URL without its _HLS_ query
+// parameters, which change on every blocking reload
+func withoutDeliveryDirectives(playlistURL string) string {
+	parsed, err := url.Parse(playlistURL)
+	if err != nil {
+		return playlistURL
+	}
+	stripDeliveryDirectives(parsed)
+	return parsed.String()
+}
+
+// fetchConditional downloads a playlist unless the server reports it is
+// unchanged since the last response. It returns nil data for 304 Not Modified.
+// Validators are kept across the delivery directives of blocking reloads.
+func (v *playlistValidators) fetchConditional(playlistURL string) ([]byte, string, error) {
+	key := withoutDeliveryDirectives(playlistURL)
+	return retryFetch(ClassPlaylist, true, nil, func() ([]byte, string, error) {
+		req, err := newRequest(ClassPlaylist, playlistURL)
+		if err != nil {
+			return nil, "", err
+		}
+		if v.URL == key {
+			if v.ETag != "" {
+				req.Header.Set("If-None-Match", v.ETag)
+			}
+			if v.LastModified != "" {
+				req.Header.Set("If-Modified-Since", v.LastModified)
+			}
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			return nil, resp.Request.URL.String(), nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", newHTTPError(resp)
+		}
+
+		data, err := readBody(resp)
+		if err != nil {
+			return nil, "", err
+		}
+		v.URL = key
+		v.ETag = resp.Header.Get("ETag")
+		v.LastModified = resp.Header.Get("Last-Modified")
+		return data, resp.Request.URL.String(), nil
+	})
+}
+
+// reloadPlaylist downloads and parses a live media playlist without the
+// messages printed on the first load. It returns nil if the playlist has not
+// changed since the response the validators were taken from.
+func reloadPlaylist(playlistURL string, customKey []byte, imports map[string]string, validators *playlistValidators) (*M3U8Playlist, error) {
+	data, finalURL, err := validators.fetchConditional(playlistURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload playlist: %w", err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	base := finalURL
+	if keepOriginalBase || base == "" {
+		base = playlistURL
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse playlist URL: %w", err)
+	}
+	stripDeliveryDirectives(baseURL)
+
+	playlist, err := parsePlaylist(bytes.NewReader(data), baseURL, customKey, true, imports)
+	if err != nil {
+		return nil, err
+	}
+	if customKey != nil && playlist.Encrypted {
+		playlist.Key = customKey
+	}
+	return playlist, nil
+}
+
+// mergeDelta applies a delta update to the held playlist: the segments
+// replaced by #EXT-X-SKIP are taken from the held playlist
+func mergeDelta(held, delta *M3U8Playlist) (*M3U8Playlist, error) {
+	skipEnd := delta.MediaSequence + delta.SkippedSegments
+	var segments []Segment
+	for _, segment := range held.Segments {
+		if segment.Sequence >= delta.MediaSequence && segment.Sequence < skipEnd {
+			segments = append(segments, segment)
+		}
+	}
+	if int64(len(segments)) != delta.SkippedSegments {
+		return nil, fmt.Errorf("delta update skips %d segment(s) but only %d are held", delta.SkippedSegments, len(segments))
+	}
+
+	merged := *delta
+	merged.Segments = append(segments, delta.Segments...)
+	merged.SkippedSegments = 0
+
+	// Tags before the skip boundary may have been skipped with the segments
+	if !merged.Encrypted && held.Encrypted {
+		merged.Encrypted = true
+		merged.KeyURL = held.KeyURL
+		merged.KeyIV = held.KeyIV
+		merged.Key = held.Key
+	}
+	if merged.InitSegment == "" && held.InitSegment != "" {
+		merged.IsFragmented = true
+		merged.InitSegment = held.InitSegment
+	}
+	merged.DateRanges = nil
+	for _, dateRange := range held.DateRanges {
+		merged.DateRanges = mergeDateRange(merged.DateRanges, dateRange)
+	}
+	for _, dateRange := range delta.DateRanges {
+		merged.DateRanges = mergeDateRange(merged.DateRanges, dateRange)
+	}
+	return &merged, nil
+}
+
+// LiveRecorder records a live media playlist from its live edge until the
+// playlist ends, the duration limit is reached or Stop is closed
+type LiveRecorder struct {
+	URL         string               // Media playlist URL
+	CustomKey   []byte               // Custom key passed to the parser
+	Imports     map[string]string    // Master playlist variables
+	MaxDuration time.Duration        // Stop after recording this much media, 0 records until the end
+	UseParts    bool                 // Download LL-HLS parts as they are published
+	HonorStart  bool                 // Start at #EXT-X-START instead of the live edge
+	SkipAds     bool                 // Leave out segments inside ad breaks
+	FromSeq     int64                // First media sequence number to record, -1 for the live edge
+	ToSeq       int64                // Last media sequence number to record, -1 for no limit
+	Metadata    *TimedMetadataWriter // Receives the ID3 timed metadata of recorded segments, if set
+	Stop        <-chan struct{}
+	Gaps        []GapRange // Segments missing from the recording
+
+	// PackedFormat is the packed audio format of the recording, judged by
+	// its first segment. Packed audio is written without its ID3 tags.
+	PackedFormat string
+
+	file       *os.File
+	next       int64    // Media sequence number of the next segment to record
+	parts      [][]byte // Parts of the next segment downloaded so far
+	prefetch   map[string][]byte
+	validators playlistValidators
+	loadedAt   time.Time // When the held playlist was last updated
+	recorded   float64   // Seconds of media written
+	position   float64   // Seconds of the stream passed, including gaps
+	segments   int
+	assembled  int // Segments assembled from parts instead of fetched whole
+	adSegments int // Ad segments left out
+	reloads    int
+	deltas     int // Reloads answered with a delta update
+	unchanged  int // Reloads answered with 304 Not Modified
+}
+
+// Record writes the live stream to path and returns when recording stops
+func (r *LiveRecorder) Record(playlist *M3U8Playlist, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer file.Close()
+	r.file = file
+	r.prefetch = make(map[string][]byte)
+	r.loadedAt = time.Now()
+
+	if playlist.IsFragmented && playlist.InitSegment != "" {
+		initData, err := DownloadContentWithRetry(playlist.InitSegment, ClassInit, true)
+		if err != nil {
+			return fmt.Errorf("failed to download initialization segment: %w", err)
+		}
+		if _, err := file.Write(initData); err != nil {
+			return fmt.Errorf("failed to write initialization segment: %w", err)
+		}
+	}
+
+	useParts := r.UseParts && playlist.PartTarget > 0
+	if useParts && (playlist.Encrypted || partsUseByteRanges(playlist)) {
+		fmt.Println("ℹ️  LL-HLS parts are encrypted or byte ranges, recording whole segments instead")
+		useParts = false
+	}
+	r.next = r.startSequence(playlist, useParts)
+
+	fmt.Printf("🔴 Recording live stream from media sequence %d", r.next)
+	if playlist.PartTarget > 0 {
+		fmt.Printf(" (LL-HLS, part target %.3fs", playlist.PartTarget)
+		if useParts {
+			fmt.Printf(", assembling parts")
+		}
+		fmt.Printf(")")
+	}
+	fmt.Println()
+	if playlist.ServerControl.CanSkipUntil > 0 {
+		fmt.Printf("Playlist delta updates supported (CAN-SKIP-UNTIL=%.0fs)\n", playlist.ServerControl.CanSkipUntil)
+	}
+	if len(playlist.RenditionReports) > 0 {
+		fmt.Printf("Rendition reports for %d other rendition(s)\n", len(playlist.RenditionReports))
+	}
+
+	failures := 0
+	for {
+		if err := r.writeSegments(playlist); err != nil {
+			return err
+		}
+		if r.ToSeq >= 0 && r.next > r.ToSeq {
+			fmt.Printf("\n✓ Reached media sequence %d, stopping\n", r.ToSeq)
+			break
+		}
+		if !playlist.IsLive {
+			fmt.Println("\n✓ Live stream ended")
+			break
+		}
+		if r.MaxDuration > 0 && r.recorded >= r.MaxDuration.Seconds() {
+			fmt.Printf("\n✓ Recorded %s, stopping\n", r.MaxDuration)
+			break
+		}
+		if useParts {
+			r.fetchParts(playlist)
+		}
+
+		if r.stopped() {
+			fmt.Println("\n✓ Recording stopped")
+			break
+		}
+
+		fresh, err := r.reload(playlist, useParts)
+		if r.stopped() {
+			fmt.Println("\n✓ Recording stopped")
+			break
+		}
+		if err != nil {
+			failures++
+			if failures >= maxReloadFailures {
+				return fmt.Errorf("giving up after %d failed reloads: %w", failures, err)
+			}
+			fmt.Printf("\nWarning: %v\n", err)
+			r.sleep(time.Duration(playlist.TargetDuration * float64(time.Second)))
+			continue
+		}
+		failures = 0
+		playlist = fresh
+	}
+
+	fmt.Printf("Recorded %d segment(s), %.1f seconds", r.segments, r.recorded)
+	if r.assembled > 0 {
+		fmt.Printf(" (%d assembled from parts)", r.assembled)
+	}
+	fmt.Println()
+	if r.adSegments > 0 {
+		fmt.Printf("Skipped %d ad segment(s)\n", r.adSegments)
+	}
+	if r.Metadata != nil {
+		fmt.Printf("ID3 tags written to %s: %d\n", r.Metadata.Path, r.Metadata.Count)
+	}
+	if r.deltas > 0 || r.unchanged > 0 {
+		fmt.Printf("Playlist reloads: %d (%d delta update(s), %d unchanged)\n", r.reloads, r.deltas, r.unchanged)
+	}
+	return nil
+}
+
+// partsUseByteRanges reports whether the playlist's parts are byte ranges of
+// a larger resource
+func partsUseByteRanges(playlist *M3U8Playlist) bool {
+	for _, part := range playlist.PendingParts {
+		if part.ByteRange != "" {
+			return true
+		}
+	}
+	for _, segment := range playlist.Segments {
+		for _, part := range segment.Parts {
+			if part.ByteRange != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startSequence picks the first segment to record. With parts the recording
+// starts at the segment being published, otherwise it starts HOLD-BACK
+// seconds (three target durations by default) from the end. FromSeq and an
+// honoured #EXT-X-START take precedence.
+func (r *LiveRecorder) startSequence(playlist *M3U8Playlist, useParts bool) int64 {
+	last := len(playlist.Segments) - 1
+	if r.FromSeq >= 0 {
+		return r.FromSeq
+	}
+	if last < 0 {
+		return 0
+	}
+	if r.HonorStart && playlist.StartPoint != nil {
+		offset := playlist.StartPoint.Offset(playlist.Segments)
+		position := 0.0
+		for _, segment := range playlist.Segments {
+			if position+segment.Duration > offset {
+				fmt.Printf("Starting at #EXT-X-START %s\n", playlist.StartPoint)
+				return segment.Sequence
+			}
+			position += segment.Duration
+		}
+	}
+	if useParts {
+		return playlist.Segments[last].Sequence + 1
+	}
+
+	holdBack := playlist.ServerControl.HoldBack
+	if holdBack == 0 {
+		holdBack = 3 * playlist.TargetDuration
+	}
+	start := last
+	for buffered := playlist.Segments[last].Duration; start > 0 && buffered < holdBack; {
+		start--
+		buffered += playlist.Segments[start].Duration
+	}
+	return playlist.Segments[start].Sequence
+}
+
+// writeSegments appends the published segments that have not been recorded
+// yet, assembling them from downloaded parts when all parts are present
+func (r *LiveRecorder) writeSegments(playlist *M3U8Playlist) error {
+	if len(playlist.Segments) > 0 && playlist.Segments[0].Sequence > r.next {
+		first := playlist.Segments[0].Sequence
+		if r.ToSeq >= 0 && first > r.ToSeq+1 {
+			first = r.ToSeq + 1
+		}
+		fmt.Printf("\n⚠️  Fell behind the live window, %d segment(s) lost\n", first-r.next)
+		// The lost segments were never listed, so they are reported with
+		// the target duration
+		for sequence := r.next; sequence < first; sequence++ {
+			r.skip(Segment{Sequence: sequence, Duration: playlist.TargetDuration}, "fell behind the live window")
+		}
+		r.parts = nil
+	}
+
+	var ads map[int64]bool
+	if r.SkipAds {
+		ads = adSequences(DetectAdBreaks(playlist))
+	}
+
+	for _, segment := range playlist.Segments {
+		if segment.Sequence < r.next {
+			continue
+		}
+		if r.MaxDuration > 0 && r.recorded >= r.MaxDuration.Seconds() {
+			return nil
+		}
+		if r.ToSeq >= 0 && segment.Sequence > r.ToSeq {
+			return nil
+		}
+
+		// The last parts may have arrived through preload hints
+		if segment.Sequence == r.next {
+			for len(r.parts) < len(segment.Parts) {
+				data, ok := r.prefetch[segment.Parts[len(r.parts)].URL]
+				if !ok {
+					break
+				}
+				r.parts = append(r.parts, data)
+			}
+		}
+
+		if segment.Gap {
+			r.skip(segment, "EXT-X-GAP")
+			continue
+		}
+		if ads[segment.Sequence] {
+			r.adSegments++
+			r.advance(segment)
+			continue
+		}
+
+		var data []byte
+		if len(segment.Parts) > 0 && len(r.parts) == len(segment.Parts) {
+			data = bytes.Join(r.parts, nil)
+			r.assembled++
+		} else {
+			var err error
+			data, err = DownloadContentWithRetry(segment.URL, ClassSegment, true)
+			if err != nil {
+				fmt.Printf("\nWarning: skipping segment %d: %v\n", segment.Sequence, err)
+				r.skip(segment, err.Error())
+				continue
+			}
+			if playlist.Encrypted {
+				data, err = DecryptSegment(data, playlist.Key, playlist.KeyIV, segment.Sequence)
+				if err != nil {
+					return fmt.Errorf("decryption of segment %d failed: %w", segment.Sequence, err)
+				}
+			}
+		}
+
+		if r.segments == 0 && !playlist.IsFragmented {
+			if r.PackedFormat = detectPackedAudio(data); r.PackedFormat != "" {
+				fmt.Printf("🎵 Packed %s audio detected\n", packedAudioNames[r.PackedFormat])
+			}
+		}
+		written := data
+		if r.PackedFormat != "" {
+			written = stripID3(data)
+		}
+		if _, err := r.file.Write(written); err != nil {
+			return fmt.Errorf("failed to write segment %d: %w", segment.Sequence, err)
+		}
+		if r.Metadata != nil {
+			if err := r.Metadata.Write("video", SegmentID3Cues(data, segment, r.position)); err != nil {
+				return err
+			}
+		}
+		r.segments++
+		r.recorded += segment.Duration
+		r.position += segment.Duration
+		r.advance(segment)
+		fmt.Printf("\r🔴 Recorded %d segment(s), %.1fs, at media sequence %d   ", r.segments, r.recorded, segment.Sequence)
+	}
+	return nil
+}
+
+// skip moves past a segment that is not recorded and notes the gap
+func (r *LiveRecorder) skip(segment Segment, reason string) {
+	r.Gaps = append(r.Gaps, GapRange{
+		Track:  "video",
+		Index:  int(segment.Sequence),
+		Start:  r.position,
+		End:    r.position + segment.Duration,
+		Reason: reason,
+	})
+	r.position += segment.Duration
+	r.advance(segment)
+}
+
+// advance moves past a segment and forgets its parts
+func (r *LiveRecorder) advance(segment Segment) {
+	r.next = segment.Sequence + 1
+	r.parts = nil
+	for _, part := range segment.Parts {
+		delete(r.prefetch, part.URL)
+	}
+}
+
+// fetchParts downloads the published parts of the next segment, then the
+// hinted part so it arrives as soon as the server has it
+func (r *LiveRecorder) fetchParts(playlist *M3U8Playlist) {
+	pendingSequence := int64(0)
+	if last := len(playlist.Segments) - 1; last >= 0 {
+		pendingSequence = playlist.Segments[last].Sequence + 1
+	}
+	if pendingSequence != r.next {
+		return
+	}
+
+	for _, part := range playlist.PendingParts[min(len(r.parts), len(playlist.PendingParts)):] {
+		if part.Gap {
+			return
+		}
+		data, ok := r.prefetch[part.URL]
+		if !ok {
+			var err error
+			data, err = DownloadContentWithRetry(part.URL, ClassSegment, true)
+			if err != nil {
+				// The parent segment will be fetched whole once it is published
+				fmt.Printf("\nWarning: failed to download part %d of segment %d: %v\n", len(r.parts), r.next, err)
+				return
+			}
+		}
+		r.parts = append(r.parts, data)
+	}
+
+	hint := playlist.PreloadHint
+	if hint != nil && hint.Type == "PART" && hint.URL != "" {
+		if _, ok := r.prefetch[hint.URL]; !ok {
+			if data, err := DownloadContentWithRetry(hint.URL, ClassSegment, true); err == nil {
+				r.prefetch[hint.URL] = data
+			}
+		}
+	}
+}
+
+// reload fetches the next version of the playlist. With CAN-BLOCK-RELOAD the
+// server holds the request until the next part or segment is available;
+// otherwise the playlist is polled every part or target duration. With
+// CAN-SKIP-UNTIL only the changes since the held playlist are requested.
+func (r *LiveRecorder) reload(held *M3U8Playlist, useParts bool) (*M3U8Playlist, error) {
+	msn, part := int64(-1), -1
+	if held.ServerControl.CanBlockReload {
+		msn = r.next
+		if useParts {
+			part = len(r.parts)
+		}
+	} else if useParts {
+		r.sleep(time.Duration(held.PartTarget * float64(time.Second)))
+	} else {
+		r.sleep(time.Duration(held.TargetDuration * float64(time.Second)))
+	}
+
+	// A delta update needs a held playlist no older than half the skip boundary
+	skipBoundary := time.Duration(held.ServerControl.CanSkipUntil * float64(time.Second))
+	skip := skipBoundary > 0 && time.Since(r.loadedAt) < skipBoundary/2
+
+	r.reloads++
+	fresh, err := reloadPlaylist(deliveryDirectivesURL(r.URL, msn, part, skip), r.CustomKey, r.Imports, &r.validators)
+	if err != nil {
+		return nil, err
+	}
+	if fresh == nil {
+		return r.notModified(held, useParts), nil
+	}
+
+	if fresh.SkippedSegments > 0 {
+		merged, err := mergeDelta(held, fresh)
+		if err != nil {
+			fmt.Printf("\nWarning: %v, reloading the full playlist\n", err)
+			// The validators are those of the delta that failed to merge
+			r.validators = playlistValidators{}
+			r.reloads++
+			fresh, err = reloadPlaylist(deliveryDirectivesURL(r.URL, msn, part, false), r.CustomKey, r.Imports, &r.validators)
+			if err != nil {
+				return nil, err
+			}
+			if fresh == nil {
+				return r.notModified(held, useParts), nil
+			}
+		} else {
+			r.deltas++
+			fresh = merged
+		}
+	}
+
+	r.loadedAt = time.Now()
+	return fresh, nil
+}
+
+// notModified counts a reload answered with 304 Not Modified and returns the
+// held playlist. A blocking reload answered with 304 returns at once, so it
+// waits a part or target duration before the next reload.
+func (r *LiveRecorder) notModified(held *M3U8Playlist, useParts bool) *M3U8Playlist {
+	r.unchanged++
+	if held.ServerControl.CanBlockReload {
+		if useParts {
+			r.sleep(time.Duration(held.PartTarget * float64(time.Second)))
+		} else {
+			r.sleep(time.Duration(held.TargetDuration * float64(time.Second)))
+		}
+	}
+	return held
+}
+
+// sleep waits for the duration or until recording is stopped
+func (r *LiveRecorder) sleep(duration time.Duration) {
+	if duration <= 0 {
+		duration = time.Second
+	}
+	select {
+	case <-time.After(duration):
+	case <-r.Stop:
+	}
+}
+
+// stopped reports whether recording was asked to stop
+func (r *LiveRecorder) stopped() bool {
+	select {
+	case <-r.Stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -3,21 +3,23 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-// headerFlags is a custom flag type to support multiple -header flags
-type headerFlags []string
+// listFlags is a custom flag type to support repeated flags such as -header
+type listFlags []string
 
-func (h *headerFlags) String() string {
+func (h *listFlags) String() string {
 	return strings.Join(*h, ", ")
 }
 
-func (h *headerFlags) Set(value string) error {
+func (h *listFlags) Set(value string) error {
 	*h = append(*h, value)
 	return nil
 }
@@ -31,12 +33,174 @@ func main() {
 	retries := flag.Int("retries", 3, "Maximum retry attempts for failed downloads")
 	timeout := flag.Int("timeout", 30, "Timeout in seconds for HTTP requests")
 	keyFile := flag.String("key", "", "Path to custom encryption key file (overrides key URL in M3U8)")
+	live := flag.Bool("live", false, "Keep recording live playlists from the live edge until they end or are interrupted with Ctrl+C")
+	liveDuration := flag.Duration("live-duration", 0, "Stop a live recording after this much media, e.g. 30m (0 records until the stream ends)")
+	llParts := flag.Bool("ll-parts", true, "Download LL-HLS partial segments as they are published when recording live")
+	skipErrors := flag.Int("skip-errors", 0, "Continue past up to N segments that fail after all retries, leaving gaps")
+	gapFiller := flag.String("gap-filler", "none", "Fill gaps in MPEG-TS output with generated media: none, black (black video and silence) or silence (requires ffmpeg)")
+	startAt := flag.String("start", "", "Download from this time: an offset (90, 1m30s, 01:30) or a date and time matched against #EXT-X-PROGRAM-DATE-TIME")
+	endAt := flag.String("end", "", "Download up to this time: an offset or a date and time, like -start")
+	trim := flag.String("trim", "none", "Trim the output to exactly -start/-end: none (whole segments), copy (nearest keyframe) or exact (re-encode) (requires ffmpeg)")
+	fromSeq := flag.Int64("from-seq", -1, "Download from this media sequence number")
+	toSeq := flag.Int64("to-seq", -1, "Download up to and including this media sequence number")
+	honorStart := flag.Bool("honor-start", false, "Start at the #EXT-X-START offset of the playlist instead of its first segment (or the live edge)")
+	skipAds := flag.Bool("skip-ads", false, "Leave out ad breaks marked by SCTE-35 date ranges or CUE-OUT/CUE-IN tags (and those found by -ad-heuristic)")
+	adHeuristicFlag := flag.Bool("ad-heuristic", false, "Without ad markers, treat runs of segments between discontinuities served from another host or directory as ad breaks")
+	chapters := flag.Bool("chapters", false, "Turn date ranges, ad breaks, discontinuities and ID3 metadata into chapters, embedded in MP4/MKV output and written as .chapters.json/.chapters.vtt")
+	id3 := flag.Bool("id3", false, "Write the ID3 timed metadata of TS and packed audio segments to a .id3.jsonl file next to the output")
+	audioOnly := flag.Bool("audio-only", false, "Download only the audio: the AUDIO rendition or an audio-only variant, saved as .m4a (.aac etc. for packed audio)")
+	videoOnly := flag.Bool("video-only", false, "Download only the video, leaving out the AUDIO rendition (muxed audio is removed with ffmpeg)")
+	allVariants := flag.Bool("all-variants", false, "Download every variant, audio rendition and subtitle rendition into its own file, or into one multi-track file with .mkv output")
+	subtitles := flag.Bool("subtitles", false, "Also download subtitle renditions as .vtt files next to the output")
 
-	var headers headerFlags
+	var headers listFlags
 	flag.Var(&headers, "header", "Custom HTTP header in format 'Key:Value' (can be used multiple times)")
+	var headerRuleSpecs listFlags
+	flag.Var(&headerRuleSpecs, "header-rule", "Scoped HTTP header in format 'host=<glob>,class=<class>|Key:Value' (can be used multiple times)")
+	headerConfig := flag.String("header-config", "", "JSON file with header rules (array of {host, class, name, value})")
+	keepOriginalBase := flag.Bool("keep-original-base", false, "Resolve relative URIs against the requested playlist URL instead of the final URL after redirects")
+	maxRedirects := flag.Int("max-redirects", 10, "Maximum redirects followed per request (0 disables redirects)")
+	redirectHeaders := flag.String("redirect-headers", "safe", "Headers on cross-host redirects: safe (drop credentials), strip (drop all custom headers) or keep (forward everything)")
+	var rewriteSpecs listFlags
+	flag.Var(&rewriteSpecs, "rewrite", "Rewrite resolved URLs with a regular expression in format 'pattern=>replacement' (can be used multiple times)")
+	var mirrorSpecs listFlags
+	flag.Var(&mirrorSpecs, "mirror", "Mirror hosts tried when a segment fails on its origin, in format 'origin=mirror1,mirror2' (can be used multiple times)")
+	propagateQueryFlag := flag.String("propagate-query", "", "Carry playlist URL query parameters (e.g. tokens) to segment, key and map URLs on the playlist's host: 'all' or a comma-separated list of names")
+	propagateQueryCrossHost := flag.Bool("propagate-query-cross-host", false, "Also carry -propagate-query parameters to URLs on other hosts, such as third-party key servers and CDNs")
+	refreshExpired := flag.Bool("refresh-expired", true, "Re-fetch the playlist when signed segment URLs expire (401/403/410) mid-download")
+	failover := flag.Bool("failover", true, "Switch to a redundant backup or lower variant of the master playlist when segments keep failing")
+	refreshHook := flag.String("refresh-hook", "", "Command run before re-fetching an expired playlist; 'Key: Value' lines it prints become headers")
+	var retryRules listFlags
+	flag.Var(&retryRules, "retry", "Retry policy 'retries=N,base=1s,max=30s,jitter=0.5', optionally prefixed with a request class such as 'segment:' (can be used multiple times)")
+
+	adaptive := flag.Bool("adaptive", false, "Adapt concurrency per host to throughput and throttling (-concurrent becomes the upper bound)")
+	var hostConcurrency listFlags
+	flag.Var(&hostConcurrency, "host-concurrent", "Per-host concurrency limit in format 'host=N' (can be used multiple times)")
+
+	limitRate := flag.String("limit-rate", "", "Maximum download rate shared by all requests, e.g. 500K or 5M (SIGUSR1 doubles, SIGUSR2 halves)")
+	limitRateFile := flag.String("limit-rate-file", "", "File containing the rate limit; re-read whenever it changes")
+
+	proxy := flag.String("proxy", "", "Proxy URL (http://, https:// or socks5://, with optional user:pass@); defaults to the proxy environment variables")
+	noProxy := flag.String("no-proxy", "", "Comma-separated hosts, domains or CIDRs that bypass the proxy")
+	keyProxy := flag.String("key-proxy", "", "Proxy URL for key requests only ('direct' to bypass the proxy)")
+	segmentProxy := flag.String("segment-proxy", "", "Proxy URL for segment and init requests only ('direct' to bypass the proxy)")
+
+	cookiesFile := flag.String("cookies", "", "Netscape cookies.txt file to seed the cookie jar from")
+	saveCookies := flag.String("save-cookies", "", "Save the cookie jar to a Netscape cookies.txt file when done")
+
+	caCert := flag.String("ca-cert", "", "Extra CA certificate bundle (PEM) to trust in addition to the system roots")
+	clientCert := flag.String("client-cert", "", "Client certificate (PEM) for mutual TLS")
+	clientKey := flag.String("client-key", "", "Client private key (PEM) for mutual TLS")
+	tlsMin := flag.String("tls-min", "", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification (unsafe)")
 
 	flag.Parse()
 
+	// Configure retry policies: -retries sets the attempts for every request
+	// class, -retry overrides individual settings
+	if *retries < 0 {
+		fmt.Println("Error: -retries can't be negative")
+		os.Exit(1)
+	}
+	DefaultRetryPolicy.MaxRetries = *retries
+	if err := ConfigureRetryPolicies(retryRules); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	hostLimits, err := parseHostLimits(hostConcurrency)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Configure bandwidth limiting
+	if *limitRate != "" {
+		rate, err := parseRate(*limitRate)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		rateLimiter.SetRate(rate)
+	}
+	if *limitRate != "" || *limitRateFile != "" {
+		handleRateSignals(rateLimiter)
+	}
+	if *limitRateFile != "" {
+		go watchRateFile(*limitRateFile, rateLimiter)
+	}
+
+	fillerKind, err := parseGapFiller(*gapFiller)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	trimMode, err := parseTrimMode(*trim)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	clipStart, err := parseClipFlag(*startAt)
+	if err != nil {
+		fmt.Printf("Error: invalid -start: %v\n", err)
+		os.Exit(1)
+	}
+	clipEnd, err := parseClipFlag(*endAt)
+	if err != nil {
+		fmt.Printf("Error: invalid -end: %v\n", err)
+		os.Exit(1)
+	}
+	bySequence := *fromSeq >= 0 || *toSeq >= 0
+	if bySequence && (clipStart != nil || clipEnd != nil) {
+		fmt.Println("Error: use either -start/-end or -from-seq/-to-seq, not both")
+		os.Exit(1)
+	}
+
+	// Configure proxies
+	proxyConfig, err := buildProxyConfig(*proxy, *noProxy, *keyProxy, *segmentProxy)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	redirectMode, err := parseRedirectHeaders(*redirectHeaders)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	transportConfig := TransportConfig{
+		Proxy: proxyConfig,
+		Redirect: &RedirectConfig{
+			MaxRedirects: *maxRedirects,
+			Headers:      redirectMode,
+		},
+		TLS: TLSConfig{
+			CAFile:     *caCert,
+			CertFile:   *clientCert,
+			KeyFile:    *clientKey,
+			MinVersion: *tlsMin,
+			Insecure:   *insecure,
+		},
+	}
+	if err := ConfigureTransport(transportConfig); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *insecure {
+		fmt.Println("⚠️  WARNING: TLS certificate verification is disabled (-insecure). Connections can be intercepted.")
+	}
+
+	// Attach a cookie jar so Set-Cookie from the playlist reaches key and segment requests
+	cookieJar := NewCookieJar()
+	httpClient.Jar = cookieJar
+	if *cookiesFile != "" {
+		count, err := cookieJar.LoadNetscape(*cookiesFile)
+		if err != nil {
+			fmt.Printf("Error loading cookies: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded %d cookie(s) from %s\n", count, *cookiesFile)
+	}
+
 	// Set timeout for HTTP client
 	httpClient.Timeout = time.Duration(*timeout) * time.Second
 
@@ -47,6 +211,74 @@ func main() {
 		fmt.Printf("Custom headers set: %d header(s)\n", len(customHeaders))
 	}
 
+	// Load scoped header rules: config file first, then command-line rules
+	var rules []HeaderRule
+	if *headerConfig != "" {
+		rules, err = LoadHeaderRules(*headerConfig)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	for _, spec := range headerRuleSpecs {
+		rule, err := parseHeaderRule(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		SetHeaderRules(rules)
+		fmt.Printf("Header rules set: %d rule(s)\n", len(rules))
+	}
+
+	SetQueryPropagation(*propagateQueryFlag, *propagateQueryCrossHost)
+	SetAdHeuristic(*adHeuristicFlag)
+	SetKeepOriginalBase(*keepOriginalBase)
+
+	if *audioOnly && *videoOnly {
+		fmt.Println("Error: -audio-only and -video-only can't be used together")
+		os.Exit(1)
+	}
+	if *allVariants && (*audioOnly || *videoOnly) {
+		fmt.Println("Error: -all-variants can't be used with -audio-only or -video-only")
+		os.Exit(1)
+	}
+	if *audioOnly {
+		SetTrackSelection(TracksAudioOnly)
+	} else if *videoOnly {
+		SetTrackSelection(TracksVideoOnly)
+	}
+
+	// Configure URL rewriting and mirrors
+	var rewriteRules []RewriteRule
+	for _, spec := range rewriteSpecs {
+		rule, err := parseRewriteRule(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		rewriteRules = append(rewriteRules, rule)
+	}
+	if len(rewriteRules) > 0 {
+		SetRewriteRules(rewriteRules)
+		fmt.Printf("URL rewrite rules set: %d rule(s)\n", len(rewriteRules))
+	}
+	mirrors := make(map[string][]string)
+	for _, spec := range mirrorSpecs {
+		origin, hosts, err := parseMirror(spec)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		mirrors[origin] = append(mirrors[origin], hosts...)
+	}
+	if len(mirrors) > 0 {
+		SetMirrors(mirrors)
+		fmt.Printf("Mirrors set for %d origin host(s)\n", len(mirrors))
+	}
+
 	// Validate inputs
 	if *url == "" {
 		fmt.Println("Error: M3U8 URL or file path is required")
@@ -62,9 +294,14 @@ func main() {
 
 	// Check if input is a local file or URL
 	isLocalFile := !strings.HasPrefix(*url, "http://") && !strings.HasPrefix(*url, "https://")
+	if isLocalFile {
+		SetPlaylistURL(*baseURL)
+	} else {
+		SetPlaylistURL(*url)
+	}
 
 	// Ensure output has correct extension
-	if !strings.HasSuffix(*output, ".ts") && !strings.HasSuffix(*output, ".mp4") {
+	if !strings.HasSuffix(*output, ".ts") && !isContainerOutput(*output) && packedFormatOf(*output) == "" {
 		*output = *output + ".ts"
 	}
 
@@ -77,14 +314,23 @@ func main() {
 		fmt.Printf("URL: %s\n", *url)
 	}
 	fmt.Printf("Output: %s\n", *output)
-	fmt.Printf("Max Concurrent Downloads: %d\n", *concurrent)
+	if *adaptive {
+		fmt.Printf("Max Concurrent Downloads: %d (adaptive)\n", *concurrent)
+	} else {
+		fmt.Printf("Max Concurrent Downloads: %d\n", *concurrent)
+	}
 	fmt.Printf("Timeout: %d seconds\n", *timeout)
+	if proxyConfig.Default != nil {
+		fmt.Printf("Proxy: %s\n", proxyConfig.Default.Redacted())
+	}
+	if rate := rateLimiter.Rate(); rate > 0 {
+		fmt.Printf("Rate Limit: %s\n", formatRate(rate))
+	}
 	fmt.Printf("Max Retries: %d\n\n", *retries)
 
 	// Step 1: Parse the M3U8 playlist
 	fmt.Println("Parsing M3U8 playlist...")
 	var playlist *M3U8Playlist
-	var err error
 
 	// Load custom encryption key if provided
 	var customKey []byte
@@ -113,113 +359,395 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Keep only the segments covering -start/-end, -from-seq/-to-seq or
+	// #EXT-X-START
+	var clip *ClipWindow
+	trimOffset := 0.0
+	recordingLive := *live && playlist.IsLive && !isLocalFile
+	if recordingLive && *allVariants {
+		fmt.Println("Error: -all-variants can't be used when recording live")
+		os.Exit(1)
+	}
+	if recordingLive && playlist.HasAudio {
+		fmt.Println("Error: -live can't record a separate audio rendition yet; use -video-only to record only the video")
+		os.Exit(1)
+	}
+
+	// Ad breaks are listed next to the output and dropped with -skip-ads
+	var skippedBreaks []AdBreak
+	if !recordingLive {
+		if breaks := DetectAdBreaks(playlist); len(breaks) > 0 {
+			reportAdBreaks(playlist, breaks, *skipAds, *output)
+			if *skipAds {
+				skippedBreaks = breaks
+			}
+		}
+	}
+
+	if recordingLive && (clipStart != nil || clipEnd != nil) {
+		fmt.Println("Warning: -start and -end are ignored when recording live")
+	} else if !recordingLive {
+		switch {
+		case clipStart != nil || clipEnd != nil:
+			clip, err = NewClipWindow(clipStart, clipEnd, playlist.Segments)
+		case bySequence:
+			clip, err = SequenceWindow(playlist.Segments, *fromSeq, *toSeq)
+		case *honorStart && playlist.StartPoint != nil:
+			fmt.Printf("Starting at #EXT-X-START %s\n", playlist.StartPoint)
+			clip = &ClipWindow{Start: playlist.StartPoint.Offset(playlist.Segments)}
+			if playlist.StartPoint.Precise && trimMode == TrimNone {
+				fmt.Println("ℹ️  PRECISE=YES: use -trim exact to start exactly at the offset instead of at its segment")
+			}
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if clip != nil {
+			trimOffset = clip.Apply(playlist)
+		}
+	}
+
 	fmt.Printf("Found %d segments to download\n", len(playlist.Segments))
 	if playlist.Encrypted {
 		fmt.Println("⚠️  Encrypted stream detected - will decrypt segments")
 	}
 	fmt.Println()
 
-	// Step 2: Download video segments
-	fmt.Println("Downloading video segments...")
-	downloader := NewDownloader(*concurrent, playlist, *retries)
-	videoSegments, err := downloader.DownloadSegments(playlist.Segments)
+	// Live playlists are recorded from the live edge until they end
+	if recordingLive {
+		recorder := &LiveRecorder{
+			URL:         playlist.URL,
+			CustomKey:   customKey,
+			Imports:     playlist.Imports,
+			MaxDuration: *liveDuration,
+			UseParts:    *llParts,
+			HonorStart:  *honorStart,
+			SkipAds:     *skipAds,
+			FromSeq:     *fromSeq,
+			ToSeq:       *toSeq,
+		}
+		if *id3 {
+			metadata, err := NewTimedMetadataWriter(timedMetadataPath(*output))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			defer metadata.Close()
+			recorder.Metadata = metadata
+		}
+
+		// As for VOD, a video variant recorded for -audio-only has its audio
+		// extracted afterwards, and -video-only strips muxed audio
+		liveOutput := *output
+		if *audioOnly && !playlist.AudioOnly {
+			liveOutput = strings.TrimSuffix(*output, filepath.Ext(*output)) + "_av.ts"
+		}
+		if *videoOnly && (packedFormatOf(*output) != "" || strings.HasSuffix(*output, ".m4a")) {
+			liveOutput = strings.TrimSuffix(*output, filepath.Ext(*output)) + ".ts"
+		}
+		finalOutput, err := recordLive(playlist, liveOutput, recorder)
+		if err != nil {
+			fmt.Printf("Error recording live stream: %v\n", err)
+			os.Exit(1)
+		}
+		if recorder.PackedFormat != "" && liveOutput != *output {
+			// Packed audio needs no extraction, only the name -output asks for
+			if isContainerOutput(*output) {
+				fmt.Printf("\nConverting audio to %s using ffmpeg...\n", strings.ToUpper(strings.TrimPrefix(filepath.Ext(*output), ".")))
+				if err := convertPackedAudio(finalOutput, *output); err != nil {
+					fmt.Printf("Error converting audio: %v\n", err)
+					fmt.Printf("Recording kept at: %s\n", finalOutput)
+					os.Exit(1)
+				}
+				os.Remove(finalOutput)
+				finalOutput = *output
+			} else {
+				name := strings.TrimSuffix(*output, filepath.Ext(*output)) + "." + recorder.PackedFormat
+				if err := os.Rename(finalOutput, name); err != nil {
+					fmt.Printf("Error renaming recording: %v\n", err)
+					os.Exit(1)
+				}
+				finalOutput = name
+			}
+		}
+		if *audioOnly && recorder.PackedFormat == "" {
+			if audioTarget := audioOutputName(*output); audioTarget != finalOutput {
+				fmt.Printf("\nExtracting the audio into %s using ffmpeg...\n", audioTarget)
+				if err := ExtractStreams(finalOutput, audioTarget, "a"); err != nil {
+					fmt.Printf("Error extracting audio: %v\n", err)
+					fmt.Printf("Recording kept at: %s\n", finalOutput)
+					os.Exit(1)
+				}
+				os.Remove(finalOutput)
+				finalOutput = audioTarget
+			}
+		}
+		if *videoOnly && recorder.PackedFormat == "" && mayCarryAudio(playlist) {
+			fmt.Printf("\nRemoving muxed audio using ffmpeg...\n")
+			if err := ExtractStreams(finalOutput, finalOutput, "v"); err != nil {
+				fmt.Printf("Error removing audio: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("✓ Audio removed")
+		}
+		saveCookieJar(cookieJar, *saveCookies)
+		absPath, _ := filepath.Abs(finalOutput)
+		fmt.Printf("\nRecording complete! File saved to:\n%s\n", absPath)
+		return
+	}
+	if playlist.IsLive {
+		fmt.Println("ℹ️  Live playlist detected - downloading the segments published so far (use -live to keep recording)")
+	}
+
+	// Step 2: Download video, audio and subtitle tracks as one job graph
+	// so they share the concurrency limit instead of running back to back
+	var tracks []*Track
+	var videoTrack, audioTrack *Track
+	var subtitleTracks []*Track
+	var ladder []*LadderFile
+	if *allVariants {
+		ladder = LadderFiles(playlist, skippedBreaks, clip, customKey)
+		fmt.Printf("All variants: %d rendition(s)\n", len(ladder))
+		for _, file := range ladder {
+			tracks = append(tracks, file.Track)
+		}
+	} else {
+		videoTrack = NewTrack("video", playlist)
+		if *failover {
+			videoTrack.Failover = NewVariantFailover(playlist, customKey)
+		}
+		tracks = append(tracks, videoTrack)
+
+		if playlist.HasAudio && len(playlist.AudioSegments) > 0 {
+			audioTrack = NewTrack("audio", audioPlaylistOf(playlist))
+			tracks = append(tracks, audioTrack)
+		}
+
+		if *subtitles {
+			subtitleTracks, _ = loadSubtitleTracks(playlist, clip)
+			tracks = append(tracks, subtitleTracks...)
+		}
+	}
+
+	fmt.Printf("Downloading %d track(s)...\n", len(tracks))
+	downloader := NewDownloader(*concurrent, playlist)
+	downloader.SetLimiter(NewConcurrencyLimiter(*concurrent, hostLimits, *adaptive))
+	downloader.SetSkipErrors(*skipErrors)
+	if *refreshExpired && !isLocalFile {
+		downloader.SetRefresher(&URLRefresher{
+			RootURL:     *url,
+			CustomKey:   customKey,
+			Hook:        *refreshHook,
+			CookiesFile: *cookiesFile,
+			Jar:         cookieJar,
+		})
+	}
+	err = downloader.DownloadTracks(tracks)
 	if err != nil {
-		fmt.Printf("Error downloading video segments: %v\n", err)
+		fmt.Printf("Error downloading segments: %v\n", err)
 		downloader.CleanupTempFiles()
 		os.Exit(1)
 	}
+	if *adaptive {
+		for host, limit := range downloader.limiter.Limits() {
+			fmt.Printf("Adaptive concurrency for %s settled at %d\n", host, limit)
+		}
+	}
+	// Subtitle tracks are best-effort and dropped when a segment fails
+	tracks = withoutDropped(tracks)
+	subtitleTracks = withoutDropped(subtitleTracks)
+	ladder = withoutDroppedFiles(ladder)
+	reportGaps(tracks, fillerKind, *output)
 
-	// Step 2.5: Download audio segments if separate audio track exists
-	var audioSegments []SegmentData
-	var audioDownloader *Downloader
-	if playlist.HasAudio && len(playlist.AudioSegments) > 0 {
+	// Every rendition is written to its own file, or muxed into one MKV
+	if *allVariants {
+		if *chapters || *id3 || trimMode != TrimNone {
+			fmt.Println("ℹ️  -chapters, -id3 and -trim are not applied with -all-variants")
+		}
 		fmt.Println()
-		fmt.Println("Downloading audio segments...")
-		audioDownloader = NewDownloader(*concurrent, playlist, *retries)
-		audioSegments, err = audioDownloader.DownloadSegments(playlist.AudioSegments)
-		if err != nil {
-			fmt.Printf("Error downloading audio segments: %v\n", err)
+		if err := WriteLadder(ladder, *output); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			downloader.CleanupTempFiles()
-			audioDownloader.CleanupTempFiles()
 			os.Exit(1)
 		}
+		downloader.CleanupTempFiles()
+		saveCookieJar(cookieJar, *saveCookies)
+
+		fmt.Println("\nDownload complete! Files saved:")
+		if strings.HasSuffix(*output, ".mkv") {
+			absPath, _ := filepath.Abs(*output)
+			fmt.Printf("%s\n", absPath)
+			return
+		}
+		for _, file := range ladder {
+			absPath, _ := filepath.Abs(file.Path)
+			fmt.Printf("%s\n", absPath)
+		}
+		return
 	}
 
+	// Timed metadata and chapters are extracted before the segment files are
+	// cleaned up, since ID3 metadata is read from the segments
+	if *id3 {
+		writeTimedMetadata(videoTrack, audioTrack, *output)
+	}
+	var chapterList []Chapter
+	if *chapters {
+		var breaks []AdBreak
+		if !*skipAds {
+			breaks = DetectAdBreaks(playlist)
+		}
+		chapterList = BuildChapters(playlist, breaks, ExtractID3Cues(videoTrack))
+		if len(chapterList) == 0 {
+			fmt.Println("ℹ️  No chapter markers found in the playlist")
+		}
+	}
+	if len(videoTrack.Renditions) > 1 {
+		fmt.Println("\nVideo renditions used:")
+		for _, line := range videoTrack.RenditionReport() {
+			fmt.Printf("  %s\n", line)
+		}
+	}
 	fmt.Println()
 
 	// Step 3: Merge segments into output file
+	// -audio-only output is written directly for audio playlists; audio
+	// muxed with video is extracted from the merged file afterwards
+	packedFormat := trackPackedAudio(videoTrack)
+	target := *output
+	audioTarget := ""
+	if *audioOnly && packedFormat == "" {
+		name := audioOutputName(*output)
+		if playlist.AudioOnly && isContainerOutput(name) {
+			target = name
+		} else {
+			audioTarget = name
+			target = strings.TrimSuffix(*output, filepath.Ext(*output)) + "_av.ts"
+			if playlist.IsFragmented {
+				target = strings.TrimSuffix(target, ".ts") + ".mp4"
+			}
+		}
+	}
+	if *videoOnly && (packedFormatOf(*output) != "" || strings.HasSuffix(*output, ".m4a")) {
+		target = strings.TrimSuffix(*output, filepath.Ext(*output)) + ".ts"
+	}
+
 	// Determine output format
-	isMP4 := strings.HasSuffix(*output, ".mp4")
-	finalOutput := *output
+	isMP4 := isContainerOutput(target)
+	finalOutput := target
 	var tempVideoFile string
 	var tempAudioFile string
 
+	// For packed audio, write the elementary stream, remuxed afterwards for
+	// MP4/M4A/MKV output
 	// For fMP4 format, output directly to MP4 (no conversion needed)
 	// For TS format with MP4 output, create temporary TS file first
-	if playlist.IsFragmented {
+	if packedFormat != "" {
+		fmt.Printf("🎵 Packed %s audio detected\n", packedAudioNames[packedFormat])
+		base := strings.TrimSuffix(target, filepath.Ext(target))
+		if isMP4 {
+			tempAudioFile = base + "_audio." + packedFormat
+			err = MergePackedAudio(videoTrack.Results, tempAudioFile)
+		} else {
+			if packedFormatOf(target) != packedFormat {
+				fmt.Printf("⚠️  Output will be .%s\n", packedFormat)
+				finalOutput = base + "." + packedFormat
+			}
+			err = MergePackedAudio(videoTrack.Results, finalOutput)
+		}
+		if err != nil {
+			fmt.Printf("Error merging audio segments: %v\n", err)
+			downloader.CleanupTempFiles()
+			os.Exit(1)
+		}
+	} else if playlist.IsFragmented {
 		// fMP4 format - segments are already MP4
 		if !isMP4 {
 			// User wants .ts but we have fMP4 - convert extension
 			fmt.Println("⚠️  Fragmented MP4 format detected - output will be .mp4")
-			finalOutput = strings.TrimSuffix(*output, filepath.Ext(*output)) + ".mp4"
+			finalOutput = strings.TrimSuffix(target, filepath.Ext(target)) + ".mp4"
 		}
 
 		// Merge video
-		tempVideoFile = strings.TrimSuffix(finalOutput, ".mp4") + "_video.mp4"
-		err = MergeSegmentsWithInit(videoSegments, downloader, tempVideoFile)
+		tempVideoFile = strings.TrimSuffix(finalOutput, filepath.Ext(finalOutput)) + "_video.mp4"
+		err = MergeSegmentsWithInit(videoTrack.Results, videoTrack.InitData, tempVideoFile)
 		if err != nil {
 			fmt.Printf("Error merging video segments: %v\n", err)
 			downloader.CleanupTempFiles()
-			if audioDownloader != nil {
-				audioDownloader.CleanupTempFiles()
-			}
 			os.Exit(1)
 		}
 
 		// Merge audio if exists
-		if playlist.HasAudio && len(audioSegments) > 0 {
-			tempAudioFile = strings.TrimSuffix(finalOutput, ".mp4") + "_audio.mp4"
-			// Create a modified playlist for audio init segment
-			audioPlaylist := *playlist
-			audioPlaylist.InitSegment = playlist.AudioInit
-			audioDownloader.playlist = &audioPlaylist
-			err = MergeSegmentsWithInit(audioSegments, audioDownloader, tempAudioFile)
+		if audioTrack != nil {
+			tempAudioFile, err = mergeAudioTrack(audioTrack, finalOutput)
 			if err != nil {
 				fmt.Printf("Error merging audio segments: %v\n", err)
 				downloader.CleanupTempFiles()
-				audioDownloader.CleanupTempFiles()
 				os.Remove(tempVideoFile)
 				os.Exit(1)
 			}
 		}
 	} else {
 		// Traditional TS format
-		if isMP4 {
-			// Create temporary TS file for conversion
-			tempVideoFile = strings.TrimSuffix(*output, ".mp4") + "_temp.ts"
+		if packedFormatOf(target) != "" {
+			fmt.Println("⚠️  MPEG-TS segments detected - output will be .ts")
+			finalOutput = strings.TrimSuffix(target, filepath.Ext(target)) + ".ts"
+		}
+		if isMP4 || audioTrack != nil {
+			// Create temporary TS file for conversion or muxing with audio
+			tempVideoFile = strings.TrimSuffix(finalOutput, filepath.Ext(finalOutput)) + "_temp.ts"
 			fmt.Printf("Creating temporary TS file: %s\n", tempVideoFile)
-			err = MergeSegments(videoSegments, tempVideoFile)
+			err = MergeSegments(videoTrack.Results, tempVideoFile)
 		} else {
-			err = MergeSegments(videoSegments, *output)
+			err = MergeSegments(videoTrack.Results, finalOutput)
 		}
 		if err != nil {
 			fmt.Printf("Error merging segments: %v\n", err)
 			downloader.CleanupTempFiles()
-			if audioDownloader != nil {
-				audioDownloader.CleanupTempFiles()
-			}
 			os.Exit(1)
 		}
+
+		// Merge audio if exists
+		if audioTrack != nil {
+			tempAudioFile, err = mergeAudioTrack(audioTrack, finalOutput)
+			if err != nil {
+				fmt.Printf("Error merging audio segments: %v\n", err)
+				downloader.CleanupTempFiles()
+				os.Remove(tempVideoFile)
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Write subtitle renditions next to the output file
+	for _, track := range subtitleTracks {
+		subtitleFile := strings.TrimSuffix(finalOutput, filepath.Ext(finalOutput)) + "." + strings.TrimPrefix(track.Name, "subtitles_") + ".vtt"
+		if err := MergeSubtitles(track.Results, subtitleFile); err != nil {
+			fmt.Printf("Warning: failed to write subtitles %s: %v\n", subtitleFile, err)
+		} else {
+			fmt.Printf("✓ Subtitles saved to: %s\n", subtitleFile)
+		}
 	}
 
 	// Clean up temporary segment files after successful merge
 	downloader.CleanupTempFiles()
-	if audioDownloader != nil {
-		audioDownloader.CleanupTempFiles()
-	}
 
 	// Step 4: Convert/Merge to final output
-	if playlist.IsFragmented {
+	if packedFormat != "" {
+		// Packed audio: remux the elementary stream into the container
+		if tempAudioFile != "" {
+			container := strings.ToUpper(strings.TrimPrefix(filepath.Ext(finalOutput), "."))
+			fmt.Printf("\nConverting audio to %s using ffmpeg...\n", container)
+			err = convertPackedAudio(tempAudioFile, finalOutput)
+			if err != nil {
+				fmt.Printf("Error converting to %s: %v\n", container, err)
+				fmt.Printf("Audio file kept at: %s\n", tempAudioFile)
+				os.Exit(1)
+			}
+			os.Remove(tempAudioFile)
+		}
+	} else if playlist.IsFragmented {
 		// fMP4: Merge video and audio using ffmpeg if audio exists
 		if playlist.HasAudio && tempAudioFile != "" {
 			fmt.Printf("\nMerging video and audio using ffmpeg...\n")
@@ -233,18 +761,41 @@ func main() {
 			os.Remove(tempVideoFile)
 			os.Remove(tempAudioFile)
 			fmt.Printf("Temporary video and audio files removed\n")
+		} else if strings.HasSuffix(finalOutput, ".mkv") {
+			// No separate audio, remux the video file into MKV
+			fmt.Printf("\nConverting to MKV using ffmpeg...\n")
+			err = convertToMP4(tempVideoFile, finalOutput)
+			if err != nil {
+				fmt.Printf("Error converting to MKV: %v\n", err)
+				fmt.Printf("Video file kept at: %s\n", tempVideoFile)
+				os.Exit(1)
+			}
+			os.Remove(tempVideoFile)
 		} else {
 			// No separate audio, rename video file to final output
 			if tempVideoFile != finalOutput {
 				os.Rename(tempVideoFile, finalOutput)
 			}
 		}
+	} else if tempAudioFile != "" {
+		// TS video with a separate audio track: mux both into the output
+		fmt.Printf("\nMerging video and audio using ffmpeg...\n")
+		err = mergeVideoAudio(tempVideoFile, tempAudioFile, finalOutput)
+		if err != nil {
+			fmt.Printf("Error merging video and audio: %v\n", err)
+			fmt.Printf("Temporary files kept:\n  Video: %s\n  Audio: %s\n", tempVideoFile, tempAudioFile)
+			os.Exit(1)
+		}
+		os.Remove(tempVideoFile)
+		os.Remove(tempAudioFile)
+		fmt.Printf("Temporary video and audio files removed\n")
 	} else if isMP4 {
-		// TS to MP4 conversion
-		fmt.Printf("\nConverting TS to MP4 using ffmpeg...\n")
+		// TS to MP4 (or MKV) conversion
+		container := strings.ToUpper(strings.TrimPrefix(filepath.Ext(finalOutput), "."))
+		fmt.Printf("\nConverting TS to %s using ffmpeg...\n", container)
 		err = convertToMP4(tempVideoFile, finalOutput)
 		if err != nil {
-			fmt.Printf("Error converting to MP4: %v\n", err)
+			fmt.Printf("Error converting to %s: %v\n", container, err)
 			fmt.Printf("Temporary TS file kept at: %s\n", tempVideoFile)
 			os.Exit(1)
 		}
@@ -254,16 +805,375 @@ func main() {
 		fmt.Printf("Temporary TS file removed\n")
 	}
 
+	// Keep only the audio or only the video streams
+	if audioTarget != "" {
+		fmt.Printf("\nExtracting the audio into %s using ffmpeg...\n", audioTarget)
+		if err := ExtractStreams(finalOutput, audioTarget, "a"); err != nil {
+			fmt.Printf("Error extracting audio: %v\n", err)
+			fmt.Printf("Merged file kept at: %s\n", finalOutput)
+			os.Exit(1)
+		}
+		os.Remove(finalOutput)
+		finalOutput = audioTarget
+	}
+	if *videoOnly && packedFormat == "" && mayCarryAudio(playlist) {
+		fmt.Printf("\nRemoving muxed audio using ffmpeg...\n")
+		if err := ExtractStreams(finalOutput, finalOutput, "v"); err != nil {
+			fmt.Printf("Error removing audio: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("✓ Audio removed")
+	}
+
+	// Cut the edges of the first and last segments
+	if clip != nil && trimMode != TrimNone {
+		fmt.Printf("\nTrimming output to %s using ffmpeg...\n", clip)
+		if err := TrimOutput(finalOutput, trimMode, trimOffset, clip); err != nil {
+			fmt.Printf("Warning: %v\nThe output keeps whole segments at the edges\n", err)
+		} else {
+			fmt.Println("✓ Output trimmed")
+			length := 0.0
+			if clip.End > 0 {
+				length = clip.End - clip.Start
+			}
+			chapterList = ShiftChapters(chapterList, trimOffset, length)
+		}
+	}
+	if len(chapterList) > 0 {
+		writeChapters(chapterList, finalOutput)
+	}
+
 	// Get file size
 	fileInfo, err := os.Stat(finalOutput)
 	if err == nil {
 		fmt.Printf("Output file size: %.2f MB\n", float64(fileInfo.Size())/(1024*1024))
 	}
 
+	saveCookieJar(cookieJar, *saveCookies)
+
 	absPath, _ := filepath.Abs(finalOutput)
 	fmt.Printf("\nDownload complete! File saved to:\n%s\n", absPath)
 }
 
+// reportGaps fills the gaps of downloaded tracks if a filler was chosen and
+// writes a gap report next to the output
+func reportGaps(tracks []*Track, fillerKind, output string) {
+	var gaps []GapRange
+	for _, track := range tracks {
+		trackGaps := track.Gaps()
+		if len(trackGaps) == 0 {
+			continue
+		}
+		gaps = append(gaps, trackGaps...)
+
+		if strings.HasPrefix(track.Name, "subtitles_") {
+			continue
+		}
+		kind := fillerKind
+		if strings.HasPrefix(track.Name, "audio") && kind == FillerBlack {
+			kind = FillerSilence
+		}
+		filled, err := FillGaps(track, kind)
+		if err != nil {
+			fmt.Printf("Warning: failed to fill %s gaps: %v\n", track.Name, err)
+		} else if filled > 0 {
+			fmt.Printf("✓ Filled %d %s gap(s) with %s\n", filled, track.Name, kind)
+		}
+	}
+	if len(gaps) == 0 {
+		return
+	}
+
+	writeGapReport(gaps, output)
+}
+
+// writeGapReport writes the gap report next to the output file
+func writeGapReport(gaps []GapRange, output string) {
+	reportPath := strings.TrimSuffix(output, filepath.Ext(output)) + ".gaps.txt"
+	if err := WriteGapReport(reportPath, gaps); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return
+	}
+	fmt.Printf("⚠️  %d segment(s) missing, gap report written to %s\n", len(gaps), reportPath)
+}
+
+// reportAdBreaks announces the ad breaks of a playlist, removes them if skip
+// is set and writes the list of breaks next to the output
+func reportAdBreaks(playlist *M3U8Playlist, breaks []AdBreak, skip bool, output string) {
+	total := 0.0
+	for _, adBreak := range breaks {
+		total += adBreak.End - adBreak.Start
+	}
+	fmt.Printf("📺 Found %d ad break(s) (%s), %.1f seconds\n", len(breaks), breaks[0].Source, total)
+
+	if skip {
+		segments := 0
+		for _, adBreak := range breaks {
+			segments += adBreak.Segments
+		}
+		if segments == len(playlist.Segments) {
+			fmt.Println("Warning: every segment is inside an ad break, keeping them")
+			skip = false
+		} else {
+			removed := SkipAdBreaks(playlist, breaks)
+			fmt.Printf("✂️  Skipping %d ad segment(s)\n", removed)
+		}
+	}
+
+	listPath := strings.TrimSuffix(output, filepath.Ext(output)) + ".adbreaks.txt"
+	if err := WriteAdBreaks(listPath, breaks, skip); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return
+	}
+	fmt.Printf("Ad break list written to %s\n", listPath)
+}
+
+// timedMetadataPath returns the JSON lines file for the ID3 metadata of output
+func timedMetadataPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".id3.jsonl"
+}
+
+// writeTimedMetadata writes the ID3 timed metadata of the downloaded video
+// and audio tracks to <base>.id3.jsonl
+func writeTimedMetadata(videoTrack, audioTrack *Track, output string) {
+	metadata, err := NewTimedMetadataWriter(timedMetadataPath(output))
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return
+	}
+	defer metadata.Close()
+
+	for _, track := range []*Track{videoTrack, audioTrack} {
+		if track == nil {
+			continue
+		}
+		if err := metadata.Write(track.Name, ExtractID3Cues(track)); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			return
+		}
+	}
+	if metadata.Count == 0 {
+		fmt.Println("ℹ️  No ID3 timed metadata found in the segments")
+		return
+	}
+	fmt.Printf("🏷️  %d ID3 tag(s) written to %s\n", metadata.Count, metadata.Path)
+}
+
+// writeChapters writes the chapter sidecars and embeds the chapters into MP4
+// and MKV output
+func writeChapters(chapters []Chapter, output string) {
+	fmt.Printf("\n📑 %d chapter(s)\n", len(chapters))
+	paths, err := WriteChapterSidecars(output, chapters)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	} else {
+		fmt.Printf("✓ Chapters saved to: %s\n", strings.Join(paths, ", "))
+	}
+
+	if !isContainerOutput(output) {
+		fmt.Printf("ℹ️  %s output can't hold chapters; use .mp4 or .mkv output to embed them\n", strings.ToUpper(strings.TrimPrefix(filepath.Ext(output), ".")))
+		return
+	}
+	if err := EmbedChapters(output, chapters); err != nil {
+		fmt.Printf("Warning: failed to embed chapters: %v\n", err)
+		return
+	}
+	fmt.Println("✓ Chapters embedded in the output")
+}
+
+// saveCookieJar saves the cookie jar if -save-cookies was given
+func saveCookieJar(jar *CookieJar, path string) {
+	if path == "" {
+		return
+	}
+	count, err := jar.SaveNetscape(path)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	} else {
+		fmt.Printf("Saved %d cookie(s) to %s\n", count, path)
+	}
+}
+
+// recordLive records a live playlist with recorder until it ends, the
+// recorder's limits are reached or Ctrl+C is pressed, and returns the output
+// file. TS and packed audio recordings are converted afterwards if MP4 output
+// was requested.
+func recordLive(playlist *M3U8Playlist, output string, recorder *LiveRecorder) (string, error) {
+	// Stop cleanly on Ctrl+C so the recording so far is kept
+	stop := make(chan struct{})
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		<-interrupts
+		fmt.Println("\nInterrupted, finishing the recording...")
+		close(stop)
+	}()
+
+	recorder.Stop = stop
+
+	finalOutput := output
+	recordPath := output
+	isMP4 := isContainerOutput(output)
+	if playlist.IsFragmented {
+		if !strings.HasSuffix(output, ".mp4") {
+			fmt.Println("⚠️  Fragmented MP4 format detected - output will be .mp4")
+			finalOutput = strings.TrimSuffix(output, filepath.Ext(output)) + ".mp4"
+		}
+		recordPath = finalOutput
+	} else if isMP4 {
+		recordPath = strings.TrimSuffix(output, filepath.Ext(output)) + "_temp.ts"
+	}
+
+	if err := recorder.Record(playlist, recordPath); err != nil {
+		return "", err
+	}
+
+	// The segment format is only known once recording has started, so
+	// packed audio and TS recordings are renamed to match it afterwards
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	if format := recorder.PackedFormat; format != "" {
+		if isMP4 {
+			audioPath := base + "_audio." + format
+			if err := os.Rename(recordPath, audioPath); err != nil {
+				return "", fmt.Errorf("failed to rename recording: %w", err)
+			}
+			recordPath = audioPath
+		} else if packedFormatOf(output) != format {
+			fmt.Printf("⚠️  Output will be .%s\n", format)
+			finalOutput = base + "." + format
+		}
+	} else if !playlist.IsFragmented && packedFormatOf(output) != "" {
+		fmt.Println("⚠️  MPEG-TS segments detected - output will be .ts")
+		finalOutput = base + ".ts"
+	}
+	if !isMP4 && recordPath != finalOutput {
+		if err := os.Rename(recordPath, finalOutput); err != nil {
+			return "", fmt.Errorf("failed to rename recording: %w", err)
+		}
+		recordPath = finalOutput
+	}
+	if len(recorder.Gaps) > 0 {
+		writeGapReport(recorder.Gaps, finalOutput)
+	}
+
+	if recordPath != finalOutput && recorder.PackedFormat != "" {
+		container := strings.ToUpper(strings.TrimPrefix(filepath.Ext(finalOutput), "."))
+		fmt.Printf("\nConverting audio to %s using ffmpeg...\n", container)
+		if err := convertPackedAudio(recordPath, finalOutput); err != nil {
+			return "", fmt.Errorf("converting to %s failed, audio recording kept at %s: %w", container, recordPath, err)
+		}
+		os.Remove(recordPath)
+	} else if recordPath != finalOutput {
+		container := strings.ToUpper(strings.TrimPrefix(filepath.Ext(finalOutput), "."))
+		fmt.Printf("\nConverting TS to %s using ffmpeg...\n", container)
+		if err := convertToMP4(recordPath, finalOutput); err != nil {
+			return "", fmt.Errorf("converting to %s failed, TS recording kept at %s: %w", container, recordPath, err)
+		}
+		os.Remove(recordPath)
+	}
+	return finalOutput, nil
+}
+
+// buildProxyConfig builds the proxy configuration from command-line flags
+func buildProxyConfig(proxy, noProxy, keyProxy, segmentProxy string) (*ProxyConfig, error) {
+	config := &ProxyConfig{
+		Environment: proxy == "",
+		PerClass:    make(map[RequestClass]*url.URL),
+		NoProxy:     parseNoProxy(noProxy),
+	}
+
+	if proxy != "" {
+		proxyURL, err := parseProxyURL(proxy)
+		if err != nil {
+			return nil, err
+		}
+		config.Default = proxyURL
+	}
+	if keyProxy != "" {
+		proxyURL, err := parseProxyURL(keyProxy)
+		if err != nil {
+			return nil, err
+		}
+		config.PerClass[ClassKey] = proxyURL
+	}
+	if segmentProxy != "" {
+		proxyURL, err := parseProxyURL(segmentProxy)
+		if err != nil {
+			return nil, err
+		}
+		config.PerClass[ClassSegment] = proxyURL
+		config.PerClass[ClassInit] = proxyURL
+	}
+
+	return config, nil
+}
+
+// audioPlaylistOf returns the playlist of the separate audio track
+func audioPlaylistOf(playlist *M3U8Playlist) *M3U8Playlist {
+	if playlist.AudioPlaylist != nil {
+		return playlist.AudioPlaylist
+	}
+	return &M3U8Playlist{
+		Segments:     playlist.AudioSegments,
+		InitSegment:  playlist.AudioInit,
+		IsFragmented: playlist.AudioInit != "",
+	}
+}
+
+// loadSubtitleTracks parses the subtitle renditions of a master playlist,
+// keeping the segments inside clip if it is set. It returns the tracks and
+// the rendition of each.
+func loadSubtitleTracks(playlist *M3U8Playlist, clip *ClipWindow) ([]*Track, []SubtitleTrack) {
+	var tracks []*Track
+	var renditions []SubtitleTrack
+	seen := make(map[string]bool)
+	for i, subtitle := range playlist.Subtitles {
+		subPlaylist, err := parseMediaPlaylist(subtitle.URL, nil, playlist.Imports)
+		if err != nil {
+			fmt.Printf("Warning: failed to parse subtitle playlist %s: %v\n", subtitle.URL, err)
+			continue
+		}
+		if clip != nil {
+			subPlaylist.Segments, _ = clip.Segments(subPlaylist.Segments)
+		}
+
+		// Name tracks after their language so sidecar files are easy to match
+		label := subtitle.Language
+		if label == "" {
+			label = fmt.Sprintf("%d", i)
+		}
+		if seen[label] {
+			label = fmt.Sprintf("%s_%d", label, i)
+		}
+		seen[label] = true
+
+		track := NewTrack("subtitles_"+label, subPlaylist)
+		track.InitSegment = ""
+		track.Optional = true
+		tracks = append(tracks, track)
+		renditions = append(renditions, subtitle)
+	}
+	return tracks, renditions
+}
+
+// mergeAudioTrack merges a separate audio track into a file next to output,
+// as fMP4, packed audio without its ID3 tags or MPEG-TS, and returns its path
+func mergeAudioTrack(track *Track, output string) (string, error) {
+	base := strings.TrimSuffix(output, filepath.Ext(output))
+	if track.Playlist.IsFragmented {
+		path := base + "_audio.mp4"
+		return path, MergeSegmentsWithInit(track.Results, track.InitData, path)
+	}
+	if format := trackPackedAudio(track); format != "" {
+		fmt.Printf("🎵 Packed %s audio detected in the audio track\n", packedAudioNames[format])
+		path := base + "_audio." + format
+		return path, MergePackedAudio(track.Results, path)
+	}
+	path := base + "_audio.ts"
+	return path, MergeSegments(track.Results, path)
+}
+
 // mergeVideoAudio uses ffmpeg to merge separate video and audio files
 func mergeVideoAudio(videoFile, audioFile, outputFile string) error {
 	// Ensure ffmpeg is available (download if necessary)
@@ -274,9 +1184,11 @@ func mergeVideoAudio(videoFile, audioFile, outputFile string) error {
 
 	// Merge video and audio using ffmpeg
 	// -i: input files (video and audio)
+	// -map: video from the first input, audio from the second, so audio
+	// muxed into the video segments doesn't replace the audio rendition
 	// -c copy: copy streams without re-encoding (fast)
 	// -y: overwrite output file
-	cmd := exec.Command(ffmpegPath, "-i", videoFile, "-i", audioFile, "-c", "copy", "-y", outputFile)
+	cmd := exec.Command(ffmpegPath, "-i", videoFile, "-i", audioFile, "-map", "0:v", "-map", "1:a", "-c", "copy", "-y", outputFile)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -287,7 +1199,14 @@ func mergeVideoAudio(videoFile, audioFile, outputFile string) error {
 	return nil
 }
 
-// convertToMP4 uses ffmpeg to convert TS to MP4
+// isContainerOutput reports whether an output file name asks for MP4, M4A or
+// MKV, which are muxed with ffmpeg
+func isContainerOutput(output string) bool {
+	return strings.HasSuffix(output, ".mp4") || strings.HasSuffix(output, ".m4a") || strings.HasSuffix(output, ".mkv")
+}
+
+// convertToMP4 uses ffmpeg to convert TS to MP4 (or MKV, after the output
+// file extension)
 func convertToMP4(tsFile, mp4File string) error {
 	// Ensure ffmpeg is available (download if necessary)
 	ffmpegPath, err := ensureFFmpeg()
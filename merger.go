@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 )
 
 // MergeSegments merges all downloaded segments into a single file
@@ -30,6 +31,9 @@ func MergeSegments(segments []SegmentData, outputPath string) error {
 		} else if segment.Data != nil {
 			// Use in-memory data
 			data = segment.Data
+		} else if segment.Missing {
+			// Gap without filler
+			continue
 		} else {
 			return fmt.Errorf("segment %d has no data", i)
 		}
@@ -48,8 +52,8 @@ func MergeSegments(segments []SegmentData, outputPath string) error {
 }
 
 // MergeSegmentsWithInit merges fMP4 segments with initialization segment
-func MergeSegmentsWithInit(segments []SegmentData, downloader *Downloader, outputPath string) error {
-	if downloader.playlist.InitSegment == "" {
+func MergeSegmentsWithInit(segments []SegmentData, initData []byte, outputPath string) error {
+	if len(initData) == 0 {
 		return fmt.Errorf("no initialization segment found for fMP4 format")
 	}
 
@@ -64,11 +68,6 @@ func MergeSegmentsWithInit(segments []SegmentData, downloader *Downloader, outpu
 
 	// Step 1: Write initialization segment first
 	fmt.Println("Writing initialization segment...")
-	initData, err := DownloadContentWithRetry(downloader.playlist.InitSegment, downloader.maxRetries)
-	if err != nil {
-		return fmt.Errorf("failed to download initialization segment: %w", err)
-	}
-
 	totalBytes, err := outFile.Write(initData)
 	if err != nil {
 		return fmt.Errorf("failed to write initialization segment: %w", err)
@@ -88,6 +87,9 @@ func MergeSegmentsWithInit(segments []SegmentData, downloader *Downloader, outpu
 		} else if segment.Data != nil {
 			// Use in-memory data
 			data = segment.Data
+		} else if segment.Missing {
+			// Gap without filler
+			continue
 		} else {
 			return fmt.Errorf("segment %d has no data", i)
 		}
@@ -104,3 +106,47 @@ func MergeSegmentsWithInit(segments []SegmentData, downloader *Downloader, outpu
 
 	return nil
 }
+
+// MergeSubtitles merges WebVTT subtitle segments into a single file.
+// Each segment carries its own WEBVTT header, so only the first one is kept.
+func MergeSubtitles(segments []SegmentData, outputPath string) error {
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create subtitle file: %w", err)
+	}
+	defer outFile.Close()
+
+	for i, segment := range segments {
+		var data []byte
+
+		if segment.FilePath != "" {
+			data, err = os.ReadFile(segment.FilePath)
+			if err != nil {
+				return fmt.Errorf("failed to read subtitle segment %d from disk: %w", i, err)
+			}
+		} else if segment.Missing {
+			continue
+		} else {
+			data = segment.Data
+		}
+
+		text := strings.ReplaceAll(string(data), "\r\n", "\n")
+		if i > 0 {
+			// Drop the header block (everything up to the first blank line)
+			if strings.HasPrefix(strings.TrimPrefix(text, "\ufeff"), "WEBVTT") {
+				if end := strings.Index(text, "\n\n"); end != -1 {
+					text = text[end+2:]
+				} else {
+					text = ""
+				}
+			}
+		}
+		text = strings.TrimRight(text, "\n") + "\n\n"
+
+		if _, err := outFile.WriteString(text); err != nil {
+			return fmt.Errorf("failed to write subtitle segment %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
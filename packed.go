@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Packed audio formats: elementary audio streams carried without a
+// container, each segment led by an ID3 tag with its timestamp
+const (
+	PackedAAC  = "aac"  // ADTS AAC
+	PackedAC3  = "ac3"  // Dolby Digital
+	PackedEAC3 = "eac3" // Dolby Digital Plus
+	PackedMP3  = "mp3"  // MPEG-1/2 Layer III
+)
+
+// detectPackedAudio returns the packed audio format of a segment, or "" if
+// it is MPEG-TS, fMP4 or not recognised. Leading ID3 tags are skipped.
+func detectPackedAudio(data []byte) string {
+	_, consumed := parseID3Tags(data)
+	data = data[consumed:]
+	if len(data) < 6 {
+		return ""
+	}
+
+	switch {
+	case data[0] == 0xFF && data[1]&0xF6 == 0xF0:
+		// ADTS: 12-bit sync word and layer 0
+		return PackedAAC
+	case data[0] == 0xFF && data[1]&0xE0 == 0xE0 && data[1]&0x06 != 0:
+		// MPEG audio: 11-bit sync word and a non-zero layer
+		return PackedMP3
+	case data[0] == 0x0B && data[1] == 0x77:
+		// AC-3 and E-AC-3 share the sync word; E-AC-3 has bsid 11-16
+		if data[5]>>3 > 10 {
+			return PackedEAC3
+		}
+		return PackedAC3
+	}
+	return ""
+}
+
+// trackPackedAudio returns the packed audio format of a downloaded track,
+// judged by its first downloaded segment
+func trackPackedAudio(track *Track) string {
+	if track.Playlist.IsFragmented {
+		return ""
+	}
+	for _, result := range track.Results {
+		if result.Missing {
+			continue
+		}
+		data := result.Data
+		if result.FilePath != "" {
+			var err error
+			if data, err = os.ReadFile(result.FilePath); err != nil {
+				return ""
+			}
+		}
+		return detectPackedAudio(data)
+	}
+	return ""
+}
+
+// stripID3 returns a packed audio segment without its leading ID3 tags
+func stripID3(data []byte) []byte {
+	_, consumed := parseID3Tags(data)
+	return data[consumed:]
+}
+
+// MergePackedAudio merges packed audio segments into one elementary stream,
+// dropping the ID3 tag in front of each segment so the output has none in
+// the middle of the stream
+func MergePackedAudio(segments []SegmentData, outputPath string) error {
+	fmt.Printf("Merging %d packed audio segments into %s...\n", len(segments), outputPath)
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outFile.Close()
+
+	totalBytes := 0
+	for i, segment := range segments {
+		var data []byte
+
+		if segment.FilePath != "" {
+			data, err = os.ReadFile(segment.FilePath)
+			if err != nil {
+				return fmt.Errorf("failed to read segment %d from disk: %w", i, err)
+			}
+		} else if segment.Data != nil {
+			data = segment.Data
+		} else if segment.Missing {
+			continue
+		} else {
+			return fmt.Errorf("segment %d has no data", i)
+		}
+
+		n, err := outFile.Write(stripID3(data))
+		if err != nil {
+			return fmt.Errorf("failed to write segment %d: %w", i, err)
+		}
+		totalBytes += n
+	}
+
+	fmt.Printf("Successfully merged %d segments (%d bytes, ID3 tags removed) into %s\n",
+		len(segments), totalBytes, outputPath)
+	return nil
+}
+
+// packedAudioNames are the display names of the packed audio formats
+var packedAudioNames = map[string]string{
+	PackedAAC:  "AAC",
+	PackedAC3:  "AC-3",
+	PackedEAC3: "E-AC-3",
+	PackedMP3:  "MP3",
+}
+
+// packedFormatOf returns the packed audio format named by a file extension
+func packedFormatOf(path string) string {
+	format := strings.TrimPrefix(filepath.Ext(path), ".")
+	if _, ok := packedAudioNames[format]; ok {
+		return format
+	}
+	return ""
+}
+
+// convertPackedAudio remuxes an elementary audio stream into an MP4, M4A or
+// MKV file with ffmpeg
+func convertPackedAudio(audioFile, outputFile string) error {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-i", audioFile, "-c", "copy"}
+	if packedFormatOf(audioFile) == PackedAAC {
+		// ADTS headers are replaced by an AudioSpecificConfig in MP4
+		args = append(args, "-bsf:a", "aac_adtstoasc")
+	}
+	args = append(args, "-y", outputFile)
+
+	output, err := exec.Command(ffmpegPath, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg conversion failed: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
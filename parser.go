@@ -2,12 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,29 +22,121 @@ var (
 	}
 
 	// Custom headers to include in all HTTP requests
-	customHeaders map[string]string
+	customHeaders   map[string]string
+	customHeadersMu sync.RWMutex
+
+	// Encryption keys already downloaded, by key URL
+	keyCache   = make(map[string][]byte)
+	keyCacheMu sync.Mutex
+
+	// Resolve relative URIs against the requested playlist URL even after redirects
+	keepOriginalBase bool
+
+	// Query parameters carried from a playlist URL to the URLs resolved from it
+	propagateAllQuery       bool
+	propagateQueryParams    []string
+	propagateQueryCrossHost bool // Also to URLs on other hosts than the playlist's
 )
 
 // SetCustomHeaders sets custom headers to be included in all HTTP requests
 func SetCustomHeaders(headers map[string]string) {
+	customHeadersMu.Lock()
+	defer customHeadersMu.Unlock()
 	customHeaders = headers
 }
 
+// MergeCustomHeaders adds or replaces custom headers while downloads are running
+func MergeCustomHeaders(headers map[string]string) {
+	customHeadersMu.Lock()
+	defer customHeadersMu.Unlock()
+	merged := make(map[string]string, len(customHeaders)+len(headers))
+	for key, value := range customHeaders {
+		merged[key] = value
+	}
+	for key, value := range headers {
+		merged[key] = value
+	}
+	customHeaders = merged
+}
+
+// Segment is a media segment of a playlist
+type Segment struct {
+	URL      string
+	Sequence int64   // Media sequence number (#EXT-X-MEDIA-SEQUENCE + position)
+	Duration float64 // Duration in seconds from #EXTINF
+	Parts    []Part  // LL-HLS partial segments making up this segment
+	Gap      bool    // Marked #EXT-X-GAP: the segment has no media and is not fetched
+
+	ProgramDateTime time.Time // Wall-clock time of the first sample, from #EXT-X-PROGRAM-DATE-TIME
+	Discontinuity   bool      // Preceded by #EXT-X-DISCONTINUITY
+	Cue             string    // Ad cue tag preceding the segment: CueOut, CueCont or CueIn
+	CueDuration     float64   // Break duration announced by #EXT-X-CUE-OUT, 0 if unknown
+}
+
+// Ad cue tags preceding a segment
+const (
+	CueOut  = "CUE-OUT"      // The segment starts an ad break
+	CueCont = "CUE-OUT-CONT" // The segment is inside an ad break
+	CueIn   = "CUE-IN"       // The segment ends an ad break
+)
+
 // M3U8Playlist represents the parsed M3U8 playlist
 type M3U8Playlist struct {
+	URL           string // URL the playlist was downloaded from (empty for local files)
 	BaseURL       string
-	Segments      []string
+	Segments      []Segment
 	IsStream      bool
+	IsLive        bool // True for media playlists without #EXT-X-ENDLIST
 	Encrypted     bool
 	KeyURL        string
 	KeyIV         string
 	Key           []byte
-	CustomKey     []byte   // Custom key provided by user (skips download)
-	IsFragmented  bool     // True if using fMP4 format (.m4s segments)
-	InitSegment   string   // Initialization segment for fMP4 (#EXT-X-MAP)
-	AudioSegments []string // Separate audio track segments
-	AudioInit     string   // Audio initialization segment (for fMP4)
-	HasAudio      bool     // True if separate audio track exists
+	CustomKey     []byte    // Custom key provided by user (skips download)
+	IsFragmented  bool      // True if using fMP4 format (.m4s segments)
+	InitSegment   string    // Initialization segment for fMP4 (#EXT-X-MAP)
+	AudioSegments []Segment // Separate audio track segments
+	AudioInit     string    // Audio initialization segment (for fMP4)
+	HasAudio      bool      // True if separate audio track exists
+	AudioOnly     bool      // True for an audio rendition or audio-only variant picked by -audio-only
+	SkippedAudio  bool      // True if -video-only left out a separate audio rendition
+
+	AudioPlaylist *M3U8Playlist   // Parsed audio rendition (carries its own key and init segment)
+	Subtitles     []SubtitleTrack // Subtitle renditions declared by the master playlist
+
+	AudioRenditions []AudioRendition // Audio renditions with a URI declared by the master playlist
+
+	Variant  *Variant          // Variant of the master playlist this playlist was selected as
+	Variants []Variant         // All variants declared by the master playlist
+	Imports  map[string]string // Master playlist variables available to #EXT-X-DEFINE:IMPORT
+
+	StartPoint *StartPoint // Preferred start from #EXT-X-START, nil if absent
+	DateRanges []DateRange // #EXT-X-DATERANGE tags, merged by ID
+
+	MediaSequence    int64             // #EXT-X-MEDIA-SEQUENCE
+	SkippedSegments  int64             // Segments replaced by #EXT-X-SKIP in a delta update
+	TargetDuration   float64           // #EXT-X-TARGETDURATION in seconds
+	PartTarget       float64           // #EXT-X-PART-INF PART-TARGET in seconds, 0 without LL-HLS
+	ServerControl    ServerControl     // #EXT-X-SERVER-CONTROL
+	PendingParts     []Part            // Parts of the segment after the last one, still being published
+	PreloadHint      *PreloadHint      // Resource the server expects to be requested next
+	RenditionReports []RenditionReport // Live edge of other renditions
+
+	quiet bool // Suppress informational messages, e.g. on live reloads
+}
+
+// AudioRendition is an audio rendition declared by #EXT-X-MEDIA:TYPE=AUDIO
+type AudioRendition struct {
+	GroupID  string
+	Name     string
+	Language string
+	URL      string
+}
+
+// SubtitleTrack is a subtitle rendition declared by #EXT-X-MEDIA:TYPE=SUBTITLES
+type SubtitleTrack struct {
+	Name     string
+	Language string
+	URL      string
 }
 
 // ParseM3U8 downloads and parses the M3U8 playlist from the given URL
@@ -50,34 +146,42 @@ func ParseM3U8(playlistURL string) (*M3U8Playlist, error) {
 
 // ParseM3U8WithKey downloads and parses the M3U8 playlist with optional custom key
 func ParseM3U8WithKey(playlistURL string, customKey []byte) (*M3U8Playlist, error) {
-	// Download the playlist
-	req, err := http.NewRequest("GET", playlistURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Add custom headers
-	for key, value := range customHeaders {
-		req.Header.Set(key, value)
-	}
+	return parseMediaPlaylist(playlistURL, customKey, nil)
+}
 
-	resp, err := httpClient.Do(req)
+// parseMediaPlaylist downloads and parses a playlist referenced by a master
+// playlist, whose variables are given as imports
+func parseMediaPlaylist(playlistURL string, customKey []byte, imports map[string]string) (*M3U8Playlist, error) {
+	// Download the playlist
+	data, finalURL, err := downloadWithRetry(playlistURL, ClassPlaylist, false, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download playlist: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download playlist: status code %d", resp.StatusCode)
+	// Parse the base URL for resolving relative URLs. After a redirect to a
+	// CDN edge, relative URIs are relative to the final URL.
+	base := playlistURL
+	if finalURL != playlistURL && finalURL != "" {
+		if keepOriginalBase {
+			fmt.Printf("Playlist redirected to %s (resolving relative URIs against the original URL)\n", finalURL)
+		} else {
+			fmt.Printf("Playlist redirected to %s (resolving relative URIs against it)\n", finalURL)
+			base = finalURL
+		}
 	}
-
-	// Parse the base URL for resolving relative URLs
-	baseURL, err := url.Parse(playlistURL)
+	baseURL, err := url.Parse(base)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse playlist URL: %w", err)
 	}
 
-	return parseM3U8Content(resp.Body, baseURL, customKey)
+	playlist, err := parsePlaylist(bytes.NewReader(data), baseURL, customKey, false, imports)
+	if err != nil {
+		return nil, err
+	}
+	if playlist.URL == "" {
+		playlist.URL = playlistURL
+	}
+	return playlist, nil
 }
 
 // ParseM3U8FromFile parses a local M3U8 file with a provided base URL
@@ -112,18 +216,46 @@ func ParseM3U8FromFileWithKey(filePath string, baseURLStr string, customKey []by
 
 // parseM3U8Content parses M3U8 content from an io.Reader
 func parseM3U8Content(reader io.Reader, baseURL *url.URL, customKey []byte) (*M3U8Playlist, error) {
+	return parsePlaylist(reader, baseURL, customKey, false, nil)
+}
+
+// parsePlaylist implements parseM3U8Content. If quiet is set, informational
+// messages are not printed. imports are the variables of the master playlist
+// the playlist was referenced by.
+func parsePlaylist(reader io.Reader, baseURL *url.URL, customKey []byte, quiet bool, imports map[string]string) (*M3U8Playlist, error) {
 	playlist := &M3U8Playlist{
 		BaseURL:       baseURL.String(),
-		Segments:      make([]string, 0),
-		AudioSegments: make([]string, 0),
+		Segments:      make([]Segment, 0),
+		AudioSegments: make([]Segment, 0),
 		IsStream:      false,
 		Encrypted:     false,
 		CustomKey:     customKey,
 		HasAudio:      false,
+		Imports:       imports,
+		quiet:         quiet,
 	}
+	variables := newPlaylistVariables(baseURL, imports, quiet)
 
-	// Track audio media declaration
+	// Track audio and subtitle media declarations
 	var audioMediaURL string
+	var audioRenditions []AudioRendition
+	var subtitles []SubtitleTrack
+	endList := false
+
+	// Track variant streams and content steering
+	var variants []Variant
+	var pendingVariant *Variant
+	var steering *contentSteering
+
+	// Track segment numbering and duration
+	var mediaSequence int64
+	var segmentDuration float64
+	var parts []Part
+	var programDateTime time.Time
+	var cue string
+	var cueDuration float64
+	gap := false
+	discontinuity := false
 
 	// Parse the playlist content
 	scanner := bufio.NewScanner(reader)
@@ -135,12 +267,44 @@ func parseM3U8Content(reader io.Reader, baseURL *url.URL, customKey []byte) (*M3
 			continue
 		}
 
+		// Variable definitions, and substitution of variable references
+		if strings.HasPrefix(line, "#EXT-X-DEFINE:") {
+			if err := variables.define(line); err != nil {
+				return nil, fmt.Errorf("invalid playlist: %w", err)
+			}
+			continue
+		}
+		line, err := variables.substitute(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid playlist: %w", err)
+		}
+
 		// Check for separate audio media (#EXT-X-MEDIA:TYPE=AUDIO)
 		if strings.HasPrefix(line, "#EXT-X-MEDIA:") && strings.Contains(line, "TYPE=AUDIO") {
 			_, audioMediaURL = parseMediaTag(line, baseURL)
 			if audioMediaURL != "" {
 				playlist.HasAudio = true
 				fmt.Printf("Separate audio track detected: %s\n", audioMediaURL)
+				attrs := parseAttributes(line)
+				audioRenditions = append(audioRenditions, AudioRendition{
+					GroupID:  attrs["GROUP-ID"],
+					Name:     attrs["NAME"],
+					Language: attrs["LANGUAGE"],
+					URL:      audioMediaURL,
+				})
+			}
+			continue
+		}
+
+		// Check for subtitle renditions (#EXT-X-MEDIA:TYPE=SUBTITLES)
+		if strings.HasPrefix(line, "#EXT-X-MEDIA:") && strings.Contains(line, "TYPE=SUBTITLES") {
+			attrs := parseAttributes(line)
+			if attrs["URI"] != "" {
+				subtitles = append(subtitles, SubtitleTrack{
+					Name:     attrs["NAME"],
+					Language: attrs["LANGUAGE"],
+					URL:      resolveURL(baseURL, attrs["URI"]),
+				})
 			}
 			continue
 		}
@@ -163,9 +327,132 @@ func parseM3U8Content(reader io.Reader, baseURL *url.URL, customKey []byte) (*M3
 			continue
 		}
 
-		// Check for stream info
+		// Sequence number of the first segment
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			mediaSequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+			playlist.MediaSequence = mediaSequence
+			continue
+		}
+
+		// Duration of the next segment
+		if strings.HasPrefix(line, "#EXTINF:") {
+			duration := strings.TrimPrefix(line, "#EXTINF:")
+			if comma := strings.Index(duration, ","); comma != -1 {
+				duration = duration[:comma]
+			}
+			segmentDuration, _ = strconv.ParseFloat(strings.TrimSpace(duration), 64)
+			continue
+		}
+
+		// Live and low-latency playlist tags
+		if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			playlist.TargetDuration, _ = strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-SERVER-CONTROL:") {
+			playlist.ServerControl = parseServerControl(line)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-SKIP:") {
+			playlist.SkippedSegments, _ = strconv.ParseInt(parseAttributes(line)["SKIPPED-SEGMENTS"], 10, 64)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-PART-INF:") {
+			playlist.PartTarget, _ = strconv.ParseFloat(parseAttributes(line)["PART-TARGET"], 64)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-PART:") {
+			parts = append(parts, parsePart(line, baseURL))
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-PRELOAD-HINT:") {
+			playlist.PreloadHint = parsePreloadHint(line, baseURL)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-RENDITION-REPORT:") {
+			playlist.RenditionReports = append(playlist.RenditionReports, parseRenditionReport(line, baseURL))
+			continue
+		}
+
+		// Preferred playback start
+		if strings.HasPrefix(line, "#EXT-X-START:") {
+			playlist.StartPoint, err = parseStartPoint(line)
+			if err != nil && !quiet {
+				fmt.Printf("Warning: %v\n", err)
+			}
+			continue
+		}
+
+		// Wall-clock time of the next segment
+		if strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:") {
+			programDateTime, err = parseProgramDateTime(strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+			if err != nil && !quiet {
+				fmt.Printf("Warning: %v\n", err)
+			}
+			continue
+		}
+
+		// Date ranges, e.g. SCTE-35 ad breaks
+		if strings.HasPrefix(line, "#EXT-X-DATERANGE:") {
+			dateRange, err := parseDateRange(line)
+			if err != nil {
+				if !quiet {
+					fmt.Printf("Warning: %v\n", err)
+				}
+				continue
+			}
+			playlist.DateRanges = mergeDateRange(playlist.DateRanges, dateRange)
+			continue
+		}
+
+		// Ad cue tags apply to the next segment
+		if strings.HasPrefix(line, "#EXT-X-CUE-OUT-CONT") {
+			cue = CueCont
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-CUE-OUT") {
+			cue = CueOut
+			cueDuration = parseCueDuration(line)
+			continue
+		}
+		if strings.HasPrefix(line, "#EXT-X-CUE-IN") {
+			cue = CueIn
+			continue
+		}
+
+		// The next segment starts a new timeline
+		if line == "#EXT-X-DISCONTINUITY" {
+			discontinuity = true
+			continue
+		}
+
+		// The next segment is missing on the server
+		if line == "#EXT-X-GAP" {
+			gap = true
+			continue
+		}
+
+		// End of a VOD or finished live playlist
+		if strings.HasPrefix(line, "#EXT-X-ENDLIST") {
+			endList = true
+			continue
+		}
+
+		// Check for stream info; the variant URI follows on the next line
 		if strings.Contains(line, "#EXT-X-STREAM-INF") {
 			playlist.IsStream = true
+			variant := parseVariant(line)
+			pendingVariant = &variant
+			continue
+		}
+
+		// Content steering server and default pathway
+		if strings.HasPrefix(line, "#EXT-X-CONTENT-STEERING:") {
+			attrs := parseAttributes(line)
+			steering = &contentSteering{PathwayID: attrs["PATHWAY-ID"]}
+			if attrs["SERVER-URI"] != "" {
+				steering.ServerURI = resolveURL(baseURL, attrs["SERVER-URI"])
+			}
 			continue
 		}
 
@@ -182,8 +469,40 @@ func parseM3U8Content(reader io.Reader, baseURL *url.URL, customKey []byte) (*M3
 			return nil, fmt.Errorf("found relative URL '%s' but no base URL provided. Use -baseurl flag to specify the base URL", line)
 		}
 
-		playlist.Segments = append(playlist.Segments, segmentURL)
+		if pendingVariant != nil {
+			pendingVariant.URL = segmentURL
+			variants = append(variants, *pendingVariant)
+			pendingVariant = nil
+		}
+
+		// Segments without their own date-time follow on from the previous one
+		if programDateTime.IsZero() && len(playlist.Segments) > 0 {
+			previous := playlist.Segments[len(playlist.Segments)-1]
+			if !previous.ProgramDateTime.IsZero() {
+				programDateTime = previous.ProgramDateTime.Add(time.Duration(previous.Duration * float64(time.Second)))
+			}
+		}
+
+		playlist.Segments = append(playlist.Segments, Segment{
+			URL:             segmentURL,
+			Sequence:        mediaSequence + playlist.SkippedSegments + int64(len(playlist.Segments)),
+			Duration:        segmentDuration,
+			Parts:           parts,
+			Gap:             gap,
+			ProgramDateTime: programDateTime,
+			Discontinuity:   discontinuity,
+			Cue:             cue,
+			CueDuration:     cueDuration,
+		})
+		segmentDuration = 0
+		parts = nil
+		programDateTime = time.Time{}
+		cue = ""
+		cueDuration = 0
+		gap = false
+		discontinuity = false
 	}
+	playlist.PendingParts = parts
 
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("error reading playlist: %w", err)
@@ -191,32 +510,90 @@ func parseM3U8Content(reader io.Reader, baseURL *url.URL, customKey []byte) (*M3
 
 	// If it's a master playlist, parse video and audio variants
 	if playlist.IsStream && len(playlist.Segments) > 0 {
-		fmt.Printf("Master playlist detected, using first video variant: %s\n", playlist.Segments[0])
-		videoPlaylist, err := ParseM3U8WithKey(playlist.Segments[0], customKey)
+		// -audio-only takes the audio rendition and leaves the video alone
+		if trackSelection == TracksAudioOnly && audioMediaURL != "" {
+			fmt.Printf("Master playlist detected, using the audio rendition only: %s\n", audioMediaURL)
+			audioPlaylist, err := parseMediaPlaylist(audioMediaURL, customKey, variables.values)
+			if err != nil {
+				return nil, err
+			}
+			audioPlaylist.AudioOnly = true
+			audioPlaylist.Subtitles = subtitles
+			if audioPlaylist.StartPoint == nil {
+				audioPlaylist.StartPoint = playlist.StartPoint
+			}
+			return audioPlaylist, nil
+		}
+
+		variants = selectVariants(variants)
+		chosen := Variant{URL: playlist.Segments[0].URL}
+		if len(variants) > 0 {
+			chosen = variants[0]
+		}
+		if steering != nil {
+			pathways := steering.priority()
+			variants = orderByPathway(variants, pathways)
+			chosen = variants[0]
+			fmt.Printf("Content steering detected, pathways in order of preference: %s\n", strings.Join(pathways, ", "))
+		}
+		kind := "video"
+		if trackSelection == TracksAudioOnly && isAudioOnlyVariant(chosen) {
+			kind = "audio-only"
+		}
+		if steering != nil {
+			fmt.Printf("Master playlist detected, using first %s variant of pathway %s: %s\n", kind, chosen.PathwayID, chosen.URL)
+		} else {
+			fmt.Printf("Master playlist detected, using first %s variant: %s\n", kind, chosen.URL)
+		}
+		if trackSelection == TracksAudioOnly && kind == "video" {
+			fmt.Println("No audio rendition or audio-only variant, the audio will be extracted from the video variant")
+		}
+		if backups := redundantVariants(variants, chosen); len(backups) > 0 {
+			fmt.Printf("Found %d redundant backup(s) of the selected variant\n", len(backups))
+		}
+
+		videoPlaylist, err := parseMediaPlaylist(chosen.URL, customKey, variables.values)
 		if err != nil {
 			return nil, err
 		}
+		videoPlaylist.Variant = &chosen
+		videoPlaylist.Variants = variants
+		videoPlaylist.AudioOnly = kind == "audio-only"
+		videoPlaylist.AudioRenditions = audioRenditions
+		if videoPlaylist.StartPoint == nil {
+			videoPlaylist.StartPoint = playlist.StartPoint
+		}
 
 		// If there's a separate audio track, download it too
-		if audioMediaURL != "" {
+		if audioMediaURL != "" && trackSelection == TracksVideoOnly {
+			fmt.Println("Video only: skipping the separate audio track")
+			videoPlaylist.SkippedAudio = true
+		} else if audioMediaURL != "" {
 			fmt.Printf("Downloading separate audio playlist: %s\n", audioMediaURL)
-			audioPlaylist, err := ParseM3U8WithKey(audioMediaURL, customKey)
+			audioPlaylist, err := parseMediaPlaylist(audioMediaURL, customKey, variables.values)
 			if err != nil {
 				fmt.Printf("Warning: failed to parse audio playlist: %v\n", err)
 			} else {
 				videoPlaylist.HasAudio = true
 				videoPlaylist.AudioSegments = audioPlaylist.Segments
 				videoPlaylist.AudioInit = audioPlaylist.InitSegment
+				videoPlaylist.AudioPlaylist = audioPlaylist
 				fmt.Printf("✓ Found %d audio segments\n", len(audioPlaylist.Segments))
 			}
 		}
 
+		if len(subtitles) > 0 {
+			fmt.Printf("Found %d subtitle rendition(s)\n", len(subtitles))
+			videoPlaylist.Subtitles = subtitles
+		}
+
 		return videoPlaylist, nil
 	}
 
 	if len(playlist.Segments) == 0 {
 		return nil, fmt.Errorf("no segments found in playlist")
 	}
+	playlist.IsLive = !endList
 
 	// If custom key was provided, use it instead of the downloaded key
 	if customKey != nil && playlist.Encrypted {
@@ -235,7 +612,88 @@ func resolveURL(base *url.URL, reference string) string {
 	}
 
 	resolved := base.ResolveReference(ref)
-	return resolved.String()
+	propagateQuery(base, resolved)
+	return rewriteURL(resolved.String())
+}
+
+// SetKeepOriginalBase makes relative URIs resolve against the requested
+// playlist URL instead of the final URL after redirects
+func SetKeepOriginalBase(keep bool) {
+	keepOriginalBase = keep
+}
+
+// SetQueryPropagation configures which query parameters of a playlist URL are
+// carried over to the URLs resolved from it: "all", or a comma-separated list
+// of parameter names. An empty spec disables propagation. Parameters are only
+// carried to URLs on the playlist's host unless crossHost is set, so tokens
+// don't leak to third-party key servers and CDNs.
+func SetQueryPropagation(spec string, crossHost bool) {
+	propagateAllQuery = false
+	propagateQueryParams = nil
+	propagateQueryCrossHost = crossHost
+
+	spec = strings.TrimSpace(spec)
+	if spec == "all" {
+		propagateAllQuery = true
+		return
+	}
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			propagateQueryParams = append(propagateQueryParams, name)
+		}
+	}
+}
+
+// propagateQuery copies the configured query parameters from the playlist URL
+// onto a resolved URL on the same host. Parameters already present on the
+// resolved URL take precedence. The raw query is appended to, not re-encoded,
+// so signed URLs keep their exact form.
+func propagateQuery(base *url.URL, resolved *url.URL) {
+	if base.RawQuery == "" || (!propagateAllQuery && len(propagateQueryParams) == 0) {
+		return
+	}
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return
+	}
+	if !propagateQueryCrossHost && !strings.EqualFold(resolved.Host, base.Host) {
+		return
+	}
+
+	existing, _ := url.ParseQuery(resolved.RawQuery)
+	var added []string
+	for _, pair := range strings.Split(base.RawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(pair, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		if propagateAllQuery || containsString(propagateQueryParams, name) {
+			added = append(added, pair)
+		}
+	}
+
+	if len(added) == 0 {
+		return
+	}
+	if resolved.RawQuery != "" {
+		resolved.RawQuery += "&"
+	}
+	resolved.RawQuery += strings.Join(added, "&")
+}
+
+// containsString reports whether a slice contains a string
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 // isAbsoluteURL checks if a URL is absolute (has a scheme)
@@ -247,6 +705,51 @@ func isAbsoluteURL(urlStr string) bool {
 	return parsed.Scheme != ""
 }
 
+// parseAttributes parses the attribute list of a tag such as
+// #EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English" into a map.
+// Quoted values are returned without their quotes.
+func parseAttributes(line string) map[string]string {
+	attrs := make(map[string]string)
+
+	// Skip the tag name
+	if colon := strings.Index(line, ":"); colon != -1 && strings.HasPrefix(line, "#") {
+		line = line[colon+1:]
+	}
+
+	for len(line) > 0 {
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.TrimSpace(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.Index(line[1:], "\"")
+			if end == -1 {
+				value, line = line[1:], ""
+			} else {
+				value, line = line[1:end+1], line[end+2:]
+			}
+			// Skip to the next attribute
+			if comma := strings.Index(line, ","); comma != -1 {
+				line = line[comma+1:]
+			} else {
+				line = ""
+			}
+		} else if comma := strings.Index(line, ","); comma != -1 {
+			value, line = line[:comma], line[comma+1:]
+		} else {
+			value, line = line, ""
+		}
+
+		attrs[key] = strings.TrimSpace(value)
+	}
+
+	return attrs
+}
+
 // parseMediaTag parses the #EXT-X-MEDIA tag to extract audio track URL
 func parseMediaTag(line string, baseURL *url.URL) (string, string) {
 	// Example: #EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",URI="audio.m3u8"
@@ -302,7 +805,9 @@ func parseMapTag(line string, baseURL *url.URL, playlist *M3U8Playlist) error {
 	// Resolve relative URL
 	playlist.InitSegment = resolveURL(baseURL, mapURI)
 
-	fmt.Printf("Fragmented MP4 detected, initialization segment: %s\n", playlist.InitSegment)
+	if !playlist.quiet {
+		fmt.Printf("Fragmented MP4 detected, initialization segment: %s\n", playlist.InitSegment)
+	}
 
 	return nil
 }
@@ -349,9 +854,18 @@ func parseKeyTag(line string, baseURL *url.URL, playlist *M3U8Playlist) error {
 
 	// Only download the encryption key if custom key is not provided
 	if playlist.CustomKey == nil {
+		// Keys are downloaded once per URL, since live playlists are reloaded often
+		keyCacheMu.Lock()
+		key, ok := keyCache[playlist.KeyURL]
+		keyCacheMu.Unlock()
+		if ok {
+			playlist.Key = key
+			return nil
+		}
+
 		// Download the encryption key
 		fmt.Printf("Downloading encryption key from: %s\n", playlist.KeyURL)
-		key, err := DownloadContent(playlist.KeyURL)
+		key, err := DownloadContentWithRetry(playlist.KeyURL, ClassKey, false)
 		if err != nil {
 			return fmt.Errorf("failed to download encryption key: %w", err)
 		}
@@ -361,57 +875,77 @@ func parseKeyTag(line string, baseURL *url.URL, playlist *M3U8Playlist) error {
 		}
 
 		playlist.Key = key
+		keyCacheMu.Lock()
+		keyCache[playlist.KeyURL] = key
+		keyCacheMu.Unlock()
 		fmt.Println("Encryption key downloaded successfully")
-	} else {
+	} else if !playlist.quiet {
 		fmt.Println("Encryption detected, will use custom key (skipping download)")
 	}
 
 	return nil
 }
 
-// DownloadContent downloads content from a URL and returns it as bytes
-func DownloadContent(url string) ([]byte, error) {
+// newRequest creates a GET request of the given class with the custom headers applied
+func newRequest(class RequestClass, url string) (*http.Request, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Add custom headers
-	for key, value := range customHeaders {
-		req.Header.Set(key, value)
+	// Add custom headers and matching header rules
+	applyHeaders(req, class)
+
+	return withRequestClass(req, class), nil
+}
+
+// DownloadContent downloads content from a URL and returns it as bytes
+func DownloadContent(url string) ([]byte, error) {
+	return DownloadContentAs(ClassSegment, url)
+}
+
+// DownloadContentAs downloads content for a request class and returns it as bytes
+func DownloadContentAs(class RequestClass, url string) ([]byte, error) {
+	data, _, err := fetchContent(class, url)
+	return data, err
+}
+
+// fetchContent downloads content for a request class and also returns the
+// final URL after redirects
+func fetchContent(class RequestClass, url string) ([]byte, string, error) {
+	req, err := newRequest(class, url)
+	if err != nil {
+		return nil, "", err
 	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+		return nil, "", newHTTPError(resp)
 	}
 
-	return io.ReadAll(resp.Body)
+	data, err := readBody(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Request.URL.String(), nil
 }
 
-// DownloadContentWithRetry downloads content with retry logic
-func DownloadContentWithRetry(url string, maxRetries int) ([]byte, error) {
-	var lastErr error
-
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		if attempt > 0 {
-			// Wait before retrying with exponential backoff
-			waitTime := time.Duration(attempt) * time.Second
-			time.Sleep(waitTime)
-		}
-
-		data, err := DownloadContent(url)
-		if err == nil {
-			return data, nil
-		}
-
-		lastErr = err
+// readBody reads a response body and verifies it against Content-Length
+func readBody(resp *http.Response) ([]byte, error) {
+	data, err := io.ReadAll(&rateLimitedReader{reader: resp.Body, limiter: rateLimiter})
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, &TruncatedError{Expected: resp.ContentLength, Got: int64(len(data))}
 	}
-
-	return nil, fmt.Errorf("failed after %d retries: %w", maxRetries, lastErr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ContentLength >= 0 && int64(len(data)) != resp.ContentLength {
+		return nil, &TruncatedError{Expected: resp.ContentLength, Got: int64(len(data))}
+	}
+	return data, nil
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter throttles all playlist, key and segment traffic
+var rateLimiter = NewRateLimiter(0)
+
+// RateLimiter is a token bucket limiting throughput in bytes per second.
+// It is shared by all download workers and can be adjusted while running.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second, 0 means unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a rate limiter; a rate of 0 disables limiting
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate: float64(bytesPerSecond),
+		last: time.Now(),
+	}
+}
+
+// SetRate changes the rate; a rate of 0 disables limiting
+func (r *RateLimiter) SetRate(bytesPerSecond int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rate = float64(bytesPerSecond)
+	r.tokens = 0
+	r.last = time.Now()
+}
+
+// Rate returns the current rate in bytes per second
+func (r *RateLimiter) Rate() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(r.rate)
+}
+
+// burst returns the bucket size, which allows up to a second of traffic at once
+func (r *RateLimiter) burst() float64 {
+	return r.rate
+}
+
+// wait consumes n bytes worth of tokens, sleeping if the bucket is in debt
+func (r *RateLimiter) wait(n int) {
+	r.mu.Lock()
+	if r.rate <= 0 {
+		r.mu.Unlock()
+		return
+	}
+
+	// Refill tokens for the time passed since the last call
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst() {
+		r.tokens = r.burst()
+	}
+	r.last = now
+
+	// Take the tokens; a negative balance is paid back by sleeping
+	r.tokens -= float64(n)
+	var delay time.Duration
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// rateLimitedReader wraps an io.Reader to throttle reads through a RateLimiter
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (rr *rateLimitedReader) Read(p []byte) (int, error) {
+	// Read in small chunks so the limit is smooth across workers
+	const chunkSize = 32 * 1024
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := rr.reader.Read(p)
+	rr.limiter.wait(n)
+	return n, err
+}
+
+// parseRate parses a rate such as "500K", "5M" or "1.5G" into bytes per second
+func parseRate(value string) (int64, error) {
+	value = strings.TrimSpace(strings.ToUpper(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "/S"), "B")
+	if value == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+
+	multiplier := 1.0
+	switch value[len(value)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid rate %q (expected e.g. 500K, 5M)", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// formatRate formats a rate for display
+func formatRate(bytesPerSecond int64) string {
+	if bytesPerSecond <= 0 {
+		return "unlimited"
+	}
+	return formatBytes(bytesPerSecond) + "/s"
+}
+
+// watchRateFile polls a file containing a rate (e.g. "2M") and applies it
+// whenever the file changes, so the limit can be adjusted during a download
+func watchRateFile(path string, limiter *RateLimiter) {
+	var lastMod time.Time
+	for {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(lastMod) {
+			lastMod = info.ModTime()
+			content, err := os.ReadFile(path)
+			if err == nil {
+				rate, err := parseRate(string(content))
+				if err != nil {
+					fmt.Printf("\nWarning: ignoring rate file %s: %v\n", path, err)
+				} else if rate != limiter.Rate() {
+					limiter.SetRate(rate)
+					fmt.Printf("\n⚙️  Rate limit changed to %s\n", formatRate(rate))
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// minSignalRate is the lowest rate SIGUSR2 halves down to, in bytes per
+// second; halving further would round to 0, which means unlimited
+const minSignalRate = 1024
+
+// handleRateSignals lets the rate limit be adjusted while a download runs:
+// SIGUSR1 doubles the rate and SIGUSR2 halves it
+func handleRateSignals(limiter *RateLimiter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			rate := limiter.Rate()
+			if rate <= 0 {
+				fmt.Printf("\nWarning: no rate limit set, ignoring %v\n", sig)
+				continue
+			}
+			if sig == syscall.SIGUSR1 {
+				rate *= 2
+			} else {
+				rate = max(rate/2, min(rate, minSignalRate))
+			}
+			limiter.SetRate(rate)
+			fmt.Printf("\n⚙️  Rate limit changed to %s\n", formatRate(rate))
+		}
+	}()
+}
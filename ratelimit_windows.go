@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// handleRateSignals is a no-op on Windows, which has no SIGUSR1/SIGUSR2.
+// Use -limit-rate-file to adjust the rate while a download runs.
+func handleRateSignals(limiter *RateLimiter) {}
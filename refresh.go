@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxFruitlessRefreshes bounds back-to-back playlist refreshes that are not
+// followed by a successful download, so a permanently forbidden track
+// doesn't loop forever
+const maxFruitlessRefreshes = 3
+
+// URLRefresher re-fetches playlists when signed segment URLs expire in the
+// middle of a download, so the job can carry on without restarting
+type URLRefresher struct {
+	RootURL     string     // Top-level playlist URL, used when the media playlist URL expired too
+	CustomKey   []byte     // Custom key passed to the parser
+	Hook        string     // Command run before refreshing; "Key: Value" lines on stdout become headers
+	CookiesFile string     // Cookie file re-loaded into Jar after the hook runs
+	Jar         *CookieJar // Cookie jar to re-seed
+
+	mu        sync.Mutex
+	fruitless map[*Track]int   // Refreshes since the track last made progress
+	succeeded map[*Track]int32 // Successful downloads at the last refresh
+}
+
+// isAuthExpired reports whether an error looks like an expired signed URL
+func isAuthExpired(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// Refresh re-fetches the playlist of a track and updates the URLs of its
+// segments. failedURL is the URL that failed for the segment at index. It
+// returns false if the segment has no fresh URL to retry with.
+func (r *URLRefresher) Refresh(track *Track, index int, failedURL string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fruitless == nil {
+		r.fruitless = make(map[*Track]int)
+		r.succeeded = make(map[*Track]int32)
+	}
+
+	// Another worker hit the same expiry and already refreshed
+	if track.jobURL(index) != failedURL {
+		return true
+	}
+
+	succeeded := atomic.LoadInt32(&track.succeeded)
+	if succeeded > r.succeeded[track] {
+		r.fruitless[track] = 0
+	}
+	if r.fruitless[track] >= maxFruitlessRefreshes {
+		return false
+	}
+	r.fruitless[track]++
+	r.succeeded[track] = succeeded
+
+	fmt.Printf("\n🔄 %s segment URLs expired, refreshing playlist...\n", track.Name)
+
+	if r.Hook != "" {
+		if err := r.runHook(); err != nil {
+			fmt.Printf("Warning: refresh hook failed: %v\n", err)
+		}
+	}
+
+	fresh, err := r.fetch(track)
+	if err != nil {
+		fmt.Printf("Warning: failed to refresh %s playlist: %v\n", track.Name, err)
+		return false
+	}
+
+	updated := track.updateURLs(fresh)
+	fmt.Printf("✓ Refreshed %d %s segment URL(s)\n", updated, track.Name)
+
+	return track.jobURL(index) != failedURL
+}
+
+// fetch downloads a fresh copy of a track's playlist. If the media playlist
+// URL itself has expired, the top-level playlist is parsed again and the
+// track's rendition is located in it by URL.
+func (r *URLRefresher) fetch(track *Track) (*M3U8Playlist, error) {
+	source := track.currentSource()
+	if source != "" {
+		fresh, err := parseMediaPlaylist(source, r.CustomKey, track.currentPlaylist().Imports)
+		if err == nil {
+			return fresh, nil
+		}
+		if r.RootURL == "" || r.RootURL == source {
+			return nil, err
+		}
+	}
+
+	if r.RootURL == "" || source == "" {
+		return nil, fmt.Errorf("no playlist URL to refresh from")
+	}
+	root, err := ParseM3U8WithKey(r.RootURL, r.CustomKey)
+	if err != nil {
+		return nil, err
+	}
+	rendition := locateRendition(root, source)
+	switch {
+	case rendition == "":
+		return nil, fmt.Errorf("refreshed playlist no longer lists the %s rendition %s", track.Name, source)
+	case rendition == root.URL:
+		return root, nil
+	case root.AudioPlaylist != nil && rendition == root.AudioPlaylist.URL:
+		return root.AudioPlaylist, nil
+	}
+	return parseMediaPlaylist(rendition, r.CustomKey, root.Imports)
+}
+
+// locateRendition returns the URL of the variant, audio or subtitle rendition
+// of a freshly parsed master playlist that was listed as source: the same
+// URL, or the same host and path once its signature changed. It returns ""
+// if there is none.
+func locateRendition(root *M3U8Playlist, source string) string {
+	candidates := []string{root.URL}
+	for _, variant := range root.Variants {
+		candidates = append(candidates, variant.URL)
+	}
+	for _, audio := range root.AudioRenditions {
+		candidates = append(candidates, audio.URL)
+	}
+	for _, subtitle := range root.Subtitles {
+		candidates = append(candidates, subtitle.URL)
+	}
+
+	for _, candidate := range candidates {
+		if candidate == source {
+			return candidate
+		}
+	}
+	for _, candidate := range candidates {
+		if hostOf(candidate) == hostOf(source) && segmentPath(candidate) == segmentPath(source) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// runHook runs the refresh hook and applies the headers it prints. The
+// cookie file is re-loaded afterwards so the hook can also refresh cookies.
+func (r *URLRefresher) runHook() error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", r.Hook)
+	} else {
+		cmd = exec.Command("sh", "-c", r.Hook)
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if headers := parseHeaders(lines); len(headers) > 0 {
+		MergeCustomHeaders(headers)
+		fmt.Printf("✓ Refresh hook updated %d header(s)\n", len(headers))
+	}
+
+	if r.CookiesFile != "" && r.Jar != nil {
+		if _, err := r.Jar.LoadNetscape(r.CookiesFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// segmentPath returns the path of a segment URL without its query, used to
+// match segments whose signature changed
+func segmentPath(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Path
+}
+
+// updateURLs replaces segment URLs with those of a fresh playlist. Segments
+// are matched by path first, then by media sequence number.
+func (t *Track) updateURLs(fresh *M3U8Playlist) int {
+	byPath := make(map[string]string, len(fresh.Segments))
+	bySequence := make(map[int64]string, len(fresh.Segments))
+	for _, segment := range fresh.Segments {
+		byPath[segmentPath(segment.URL)] = segment.URL
+		bySequence[segment.Sequence] = segment.URL
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	updated := 0
+	for i := range t.Segments {
+		newURL, ok := byPath[segmentPath(t.Segments[i].URL)]
+		if !ok {
+			newURL, ok = bySequence[t.Segments[i].Sequence]
+		}
+		if ok && newURL != t.Segments[i].URL {
+			t.Segments[i].URL = newURL
+			updated++
+		}
+	}
+
+	if fresh.URL != "" {
+		t.Source = fresh.URL
+	}
+	if t.InitSegment != "" && fresh.InitSegment != "" && fresh.InitSegment != t.InitSegment {
+		t.InitSegment = fresh.InitSegment
+		updated++
+	}
+
+	return updated
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestClass identifies what a request fetches, so policies can be
+// configured per kind of request
+type RequestClass string
+
+const (
+	ClassPlaylist RequestClass = "playlist"
+	ClassKey      RequestClass = "key"
+	ClassInit     RequestClass = "init"
+	ClassSegment  RequestClass = "segment"
+)
+
+// requestClasses lists all request classes in a stable order
+var requestClasses = []RequestClass{ClassPlaylist, ClassKey, ClassInit, ClassSegment}
+
+// parseRequestClass converts a class name such as "segment" to a RequestClass
+func parseRequestClass(name string) (RequestClass, error) {
+	for _, class := range requestClasses {
+		if string(class) == strings.ToLower(strings.TrimSpace(name)) {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unknown request class %q (expected playlist, key, init or segment)", name)
+}
+
+// RetryPolicy controls how failed requests are retried
+type RetryPolicy struct {
+	MaxRetries int           // Retry attempts after the first request
+	BaseDelay  time.Duration // Delay before the first retry, doubled on each attempt
+	MaxDelay   time.Duration // Upper bound for the backoff delay
+	Jitter     float64       // Fraction of the delay that is randomized (0-1)
+}
+
+// DefaultRetryPolicy is used for every request class unless overridden
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  1 * time.Second,
+	MaxDelay:   30 * time.Second,
+	Jitter:     0.5,
+}
+
+// maxRetryAfter bounds how long a Retry-After header can make us wait
+const maxRetryAfter = 10 * time.Minute
+
+var (
+	retryPolicies   = make(map[RequestClass]RetryPolicy)
+	retryPoliciesMu sync.RWMutex
+)
+
+// SetRetryPolicy sets the retry policy for a request class
+func SetRetryPolicy(class RequestClass, policy RetryPolicy) {
+	retryPoliciesMu.Lock()
+	defer retryPoliciesMu.Unlock()
+	retryPolicies[class] = policy
+}
+
+// RetryPolicyFor returns the retry policy for a request class
+func RetryPolicyFor(class RequestClass) RetryPolicy {
+	retryPoliciesMu.RLock()
+	defer retryPoliciesMu.RUnlock()
+	if policy, ok := retryPolicies[class]; ok {
+		return policy
+	}
+	return DefaultRetryPolicy
+}
+
+// Backoff returns the exponential backoff delay before the given retry attempt (1-based)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	// Randomize part of the delay so concurrent workers don't retry in lockstep
+	if p.Jitter > 0 && delay > 0 {
+		jitter := time.Duration(float64(delay) * p.Jitter)
+		delay = delay - jitter + time.Duration(rand.Int63n(int64(jitter)+1))
+	}
+
+	return delay
+}
+
+// parseRetryPolicy parses a policy spec such as "retries=5,base=500ms,max=30s,jitter=0.3"
+// on top of an existing policy
+func parseRetryPolicy(spec string, policy RetryPolicy) (RetryPolicy, error) {
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return policy, fmt.Errorf("invalid retry option %q (expected key=value)", field)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch key {
+		case "retries":
+			policy.MaxRetries, err = strconv.Atoi(value)
+			if err == nil && policy.MaxRetries < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "base":
+			policy.BaseDelay, err = time.ParseDuration(value)
+			if err == nil && policy.BaseDelay < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "max":
+			policy.MaxDelay, err = time.ParseDuration(value)
+			if err == nil && policy.MaxDelay < 0 {
+				err = fmt.Errorf("can't be negative")
+			}
+		case "jitter":
+			policy.Jitter, err = strconv.ParseFloat(value, 64)
+			if err == nil && (policy.Jitter < 0 || policy.Jitter > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		default:
+			return policy, fmt.Errorf("unknown retry option %q", key)
+		}
+		if err != nil {
+			return policy, fmt.Errorf("invalid retry option %q: %w", field, err)
+		}
+	}
+	return policy, nil
+}
+
+// ConfigureRetryPolicies applies -retry flag values. Each value is either a
+// policy spec applied to all classes, or "class:spec" for a single class.
+func ConfigureRetryPolicies(specs []string) error {
+	for _, spec := range specs {
+		classes := requestClasses
+		if colon := strings.Index(spec, ":"); colon != -1 {
+			class, err := parseRequestClass(spec[:colon])
+			if err != nil {
+				return err
+			}
+			classes = []RequestClass{class}
+			spec = spec[colon+1:]
+		}
+
+		for _, class := range classes {
+			policy, err := parseRetryPolicy(spec, RetryPolicyFor(class))
+			if err != nil {
+				return err
+			}
+			SetRetryPolicy(class, policy)
+		}
+	}
+	return nil
+}
+
+// HTTPError is returned for responses with an unexpected status code
+type HTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration // Parsed Retry-After header, if any
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("status code %d", e.StatusCode)
+}
+
+// newHTTPError creates an HTTPError from a response
+func newHTTPError(resp *http.Response) *HTTPError {
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After value in seconds or HTTP-date form
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// TruncatedError is returned when a body is shorter than its Content-Length
+type TruncatedError struct {
+	Expected int64
+	Got      int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("truncated body: expected %d bytes, got %d", e.Expected, e.Got)
+}
+
+// shouldRetry classifies an error and returns whether it is worth retrying and
+// the minimum wait requested by the server. Missing resources fail fast, except
+// on live playlists where segments may not have propagated to the edge yet.
+func shouldRetry(err error, live bool) (bool, time.Duration) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusNotFound, http.StatusGone:
+			return live, 0
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true, httpErr.RetryAfter
+		}
+		// Redirects left unfollowed by -max-redirects 0 won't change
+		if httpErr.StatusCode >= 300 && httpErr.StatusCode < 400 {
+			return false, 0
+		}
+		return true, 0
+	}
+
+	// Neither will redirect loops
+	if errors.Is(err, errTooManyRedirects) {
+		return false, 0
+	}
+
+	// Certificate problems won't fix themselves
+	var certErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostErr) {
+		return false, 0
+	}
+
+	// Timeouts, connection resets, truncated bodies and other transport
+	// errors are transient
+	return true, 0
+}
+
+// DownloadContentWithRetry downloads content using the retry policy of its request class
+func DownloadContentWithRetry(url string, class RequestClass, live bool) ([]byte, error) {
+	data, _, err := downloadWithRetry(url, class, live, nil)
+	return data, err
+}
+
+// downloadWithRetry implements DownloadContentWithRetry and also returns the
+// final URL after redirects. If observe is not nil it is called with the
+// outcome of every attempt.
+func downloadWithRetry(url string, class RequestClass, live bool, observe func(bytes int, err error)) ([]byte, string, error) {
+	return retryFetch(class, live, observe, func() ([]byte, string, error) {
+		return fetchContent(class, url)
+	})
+}
+
+// retryFetch calls fetch until it succeeds or the retry policy of the request
+// class gives up
+func retryFetch(class RequestClass, live bool, observe func(bytes int, err error), fetch func() ([]byte, string, error)) ([]byte, string, error) {
+	policy := RetryPolicyFor(class)
+	var lastErr error
+
+	for attempt := 0; attempt <= policy.MaxRetries; attempt++ {
+		data, finalURL, err := fetch()
+		if observe != nil {
+			observe(len(data), err)
+		}
+		if err == nil {
+			return data, finalURL, nil
+		}
+		lastErr = err
+
+		retry, retryAfter := shouldRetry(err, live)
+		if !retry {
+			return nil, "", err
+		}
+		if attempt == policy.MaxRetries {
+			break
+		}
+
+		// Wait before retrying with exponential backoff, honoring Retry-After
+		wait := policy.Backoff(attempt + 1)
+		if retryAfter > wait {
+			wait = retryAfter
+			if wait > maxRetryAfter {
+				wait = maxRetryAfter
+			}
+		}
+		time.Sleep(wait)
+	}
+
+	return nil, "", fmt.Errorf("failed after %d retries: %w", policy.MaxRetries, lastErr)
+}
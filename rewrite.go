@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RewriteRule rewrites resolved URLs matching a regular expression.
+// The replacement can reference capture groups as $1 or ${name}.
+type RewriteRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+var (
+	rewriteRules []RewriteRule
+
+	// mirrorHosts maps an origin host to the mirrors tried when it fails
+	mirrorHosts   map[string][]string
+	mirrorHostsMu sync.RWMutex
+)
+
+// parseRewriteRule parses a -rewrite value in format "pattern=>replacement"
+func parseRewriteRule(spec string) (RewriteRule, error) {
+	parts := strings.SplitN(spec, "=>", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q (expected 'pattern=>replacement')", spec)
+	}
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite pattern %q: %w", parts[0], err)
+	}
+	return RewriteRule{Pattern: pattern, Replacement: parts[1]}, nil
+}
+
+// SetRewriteRules sets the rules applied to every resolved URL
+func SetRewriteRules(rules []RewriteRule) {
+	rewriteRules = rules
+}
+
+// rewriteURL applies the rewrite rules in order
+func rewriteURL(rawURL string) string {
+	for _, rule := range rewriteRules {
+		rawURL = rule.Pattern.ReplaceAllString(rawURL, rule.Replacement)
+	}
+	return rawURL
+}
+
+// parseMirror parses a -mirror value in format "origin=mirror1,mirror2".
+// Mirrors are hosts, optionally with a scheme such as "https://mirror.example.com".
+func parseMirror(spec string) (string, []string, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return "", nil, fmt.Errorf("invalid mirror %q (expected 'origin=mirror1,mirror2')", spec)
+	}
+
+	var mirrors []string
+	for _, mirror := range strings.Split(parts[1], ",") {
+		mirror = strings.TrimSuffix(strings.TrimSpace(mirror), "/")
+		if mirror == "" {
+			continue
+		}
+		if strings.Contains(mirror, "://") {
+			parsed, err := url.Parse(mirror)
+			if err != nil || parsed.Host == "" {
+				return "", nil, fmt.Errorf("invalid mirror %q in %q", mirror, spec)
+			}
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	if len(mirrors) == 0 {
+		return "", nil, fmt.Errorf("mirror %q lists no mirror hosts", spec)
+	}
+	return strings.ToLower(strings.TrimSpace(parts[0])), mirrors, nil
+}
+
+// SetMirrors sets the mirror hosts for each origin host
+func SetMirrors(mirrors map[string][]string) {
+	mirrorHostsMu.Lock()
+	defer mirrorHostsMu.Unlock()
+	mirrorHosts = mirrors
+}
+
+// mirrorURLs returns a URL with its host replaced by each mirror of its origin,
+// in the configured order
+func mirrorURLs(rawURL string) []string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+
+	mirrorHostsMu.RLock()
+	mirrors, ok := mirrorHosts[strings.ToLower(parsed.Host)]
+	if !ok {
+		mirrors = mirrorHosts[strings.ToLower(parsed.Hostname())]
+	}
+	mirrorHostsMu.RUnlock()
+
+	urls := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		alternate := *parsed
+		if scheme, host, found := strings.Cut(mirror, "://"); found {
+			alternate.Scheme = scheme
+			alternate.Host = host
+		} else {
+			alternate.Host = mirror
+		}
+		urls = append(urls, alternate.String())
+	}
+	return urls
+}
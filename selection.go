@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Track selections for -audio-only and -video-only
+const (
+	TracksAll       = "all"
+	TracksAudioOnly = "audio"
+	TracksVideoOnly = "video"
+)
+
+// Which tracks of a master playlist are downloaded
+var trackSelection = TracksAll
+
+// SetTrackSelection sets which tracks of a master playlist are downloaded:
+// TracksAll, TracksAudioOnly or TracksVideoOnly
+func SetTrackSelection(selection string) {
+	trackSelection = selection
+}
+
+// Codec prefixes used in CODECS attributes, by media type
+var (
+	audioCodecPrefixes = []string{"mp4a", "ac-3", "ec-3", "ac-4", "mp3", "opus", "flac", "alac"}
+	videoCodecPrefixes = []string{"avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "vp08", "vp09", "av01", "mp4v"}
+)
+
+// codecKinds reports whether a CODECS attribute lists audio and video codecs
+func codecKinds(codecs string) (audio, video bool) {
+	for _, codec := range strings.Split(codecs, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		for _, prefix := range audioCodecPrefixes {
+			if strings.HasPrefix(codec, prefix) {
+				audio = true
+			}
+		}
+		for _, prefix := range videoCodecPrefixes {
+			if strings.HasPrefix(codec, prefix) {
+				video = true
+			}
+		}
+	}
+	return audio, video
+}
+
+// isAudioOnlyVariant reports whether a variant declares audio codecs only
+func isAudioOnlyVariant(variant Variant) bool {
+	audio, video := codecKinds(variant.Codecs)
+	return audio && !video
+}
+
+// selectVariants keeps the variants matching the track selection: the
+// audio-only variants for -audio-only, the others for -video-only. All
+// variants are kept if none match.
+func selectVariants(variants []Variant) []Variant {
+	if trackSelection == TracksAll {
+		return variants
+	}
+
+	var selected []Variant
+	for _, variant := range variants {
+		if isAudioOnlyVariant(variant) == (trackSelection == TracksAudioOnly) {
+			selected = append(selected, variant)
+		}
+	}
+	if len(selected) == 0 {
+		return variants
+	}
+	return selected
+}
+
+// audioOutputName returns the output file for -audio-only: output itself if
+// it names an audio or Matroska file, otherwise output with an .m4a extension
+func audioOutputName(output string) string {
+	switch ext := filepath.Ext(output); {
+	case ext == ".m4a" || ext == ".mka" || ext == ".mkv" || packedFormatOf(output) != "":
+		return output
+	default:
+		return strings.TrimSuffix(output, ext) + ".m4a"
+	}
+}
+
+// mayCarryAudio reports whether the video segments of a playlist can hold
+// audio that -video-only has to strip. Variants whose audio came from a
+// separate rendition, or whose CODECS list no audio codec, have none.
+func mayCarryAudio(playlist *M3U8Playlist) bool {
+	if playlist.SkippedAudio {
+		return false
+	}
+	if playlist.Variant == nil || playlist.Variant.Codecs == "" {
+		return true
+	}
+	audio, _ := codecKinds(playlist.Variant.Codecs)
+	return audio
+}
+
+// ExtractStreams copies the audio ("a") or video ("v") streams of input into
+// output with ffmpeg, without re-encoding. Input and output can be the same
+// file.
+func ExtractStreams(input, output, streams string) error {
+	ffmpegPath, err := ensureFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(output)
+	extracted := strings.TrimSuffix(output, ext) + "_" + streams + ext
+	cmd := exec.Command(ffmpegPath, "-i", input, "-map", "0:"+streams, "-c", "copy", "-y", extracted)
+	result, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(extracted)
+		return fmt.Errorf("ffmpeg stream extraction failed: %w\nOutput: %s", err, string(result))
+	}
+	if err := os.Rename(extracted, output); err != nil {
+		return fmt.Errorf("failed to replace output with extracted streams: %w", err)
+	}
+	return nil
+}
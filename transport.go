@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// requestClassKey is the context key carrying a request's RequestClass
+type requestClassKey struct{}
+
+// withRequestClass tags a request with its class so the transport can route it
+func withRequestClass(req *http.Request, class RequestClass) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestClassKey{}, class))
+}
+
+// requestClassOf returns the class a request was tagged with
+func requestClassOf(req *http.Request) RequestClass {
+	if class, ok := req.Context().Value(requestClassKey{}).(RequestClass); ok {
+		return class
+	}
+	return ""
+}
+
+// ProxyConfig selects the proxy for each request
+type ProxyConfig struct {
+	Default     *url.URL                  // Proxy for all requests, nil means direct
+	Environment bool                      // Use the proxy environment variables instead of Default
+	PerClass    map[RequestClass]*url.URL // Overrides per request class, nil value means direct
+	NoProxy     []string                  // Hosts, domains or CIDRs that bypass the proxy
+}
+
+// parseProxyURL validates a proxy URL. "direct" disables proxying.
+func parseProxyURL(value string) (*url.URL, error) {
+	if value == "direct" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", value, err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// net/http only knows socks5h from Go 1.22 on; its socks5 dialer
+		// already leaves host name resolution to the proxy
+		proxyURL.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (expected http, https or socks5)", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", value)
+	}
+	return proxyURL, nil
+}
+
+// parseNoProxy splits a comma-separated no-proxy list
+func parseNoProxy(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// bypass reports whether a host matches the no-proxy list. Entries can be
+// "*", an IP or CIDR, or a domain which also matches its subdomains.
+func (c *ProxyConfig) bypass(host string) bool {
+	host = strings.ToLower(host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range c.NoProxy {
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyFor returns the proxy for a request, for use as http.Transport.Proxy
+func (c *ProxyConfig) proxyFor(req *http.Request) (*url.URL, error) {
+	if c.bypass(req.URL.Host) {
+		return nil, nil
+	}
+	if proxyURL, ok := c.PerClass[requestClassOf(req)]; ok {
+		return proxyURL, nil
+	}
+	if c.Environment {
+		return http.ProxyFromEnvironment(req)
+	}
+	return c.Default, nil
+}
+
+// TLSConfig holds certificate settings for HTTPS connections
+type TLSConfig struct {
+	CAFile     string // Extra PEM bundle trusted in addition to the system roots
+	CertFile   string // Client certificate (PEM) for mutual TLS
+	KeyFile    string // Client private key (PEM) for mutual TLS
+	MinVersion string // Minimum TLS version: 1.0, 1.1, 1.2 or 1.3
+	Insecure   bool   // Skip server certificate verification
+}
+
+// tlsVersions maps -tls-min values to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// buildTLSConfig creates a crypto/tls configuration from the settings
+func buildTLSConfig(config TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.MinVersion != "" {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if config.Insecure {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
+// Cross-host redirect header modes
+const (
+	RedirectHeadersSafe  = "safe"  // Drop credentials on cross-host redirects, re-apply host-scoped rules
+	RedirectHeadersStrip = "strip" // Drop all custom headers on cross-host redirects, re-apply host-scoped rules
+	RedirectHeadersKeep  = "keep"  // Forward all headers, including credentials, to the new host
+)
+
+// errTooManyRedirects is returned when a request exceeds the redirect limit
+var errTooManyRedirects = errors.New("too many redirects")
+
+// RedirectConfig controls how redirects are followed
+type RedirectConfig struct {
+	MaxRedirects int    // Redirects followed per request, 0 disables following
+	Headers      string // Cross-host header handling: safe, strip or keep
+
+	mu     sync.Mutex
+	logged map[string]bool // Segment redirect host pairs already logged
+}
+
+// parseRedirectHeaders validates a -redirect-headers value
+func parseRedirectHeaders(value string) (string, error) {
+	switch value {
+	case RedirectHeadersSafe, RedirectHeadersStrip, RedirectHeadersKeep:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid redirect header mode %q (expected safe, strip or keep)", value)
+}
+
+// checkRedirect enforces the redirect limit, logs the redirect and adjusts
+// headers for the new host, for use as http.Client.CheckRedirect
+func (c *RedirectConfig) checkRedirect(req *http.Request, via []*http.Request) error {
+	if c.MaxRedirects == 0 {
+		// The redirect response itself is returned, and fails as an
+		// unexpected status
+		return http.ErrUseLastResponse
+	}
+	if len(via) > c.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects: %w", c.MaxRedirects, errTooManyRedirects)
+	}
+
+	class := requestClassOf(req)
+	previous := via[len(via)-1]
+	c.log(class, previous.URL, req.URL)
+
+	// Go has already copied the original headers, minus credentials when
+	// the new host is not the original host or one of its subdomains
+	original := via[0]
+	if strings.EqualFold(original.URL.Hostname(), req.URL.Hostname()) {
+		// Only the {url} template can differ
+		applyRedirectHeaders(req, class)
+		return nil
+	}
+
+	switch c.Headers {
+	case RedirectHeadersKeep:
+		for _, name := range []string{"Authorization", "Cookie"} {
+			if value := original.Header.Get(name); value != "" && req.Header.Get(name) == "" {
+				req.Header.Set(name, value)
+			}
+		}
+	case RedirectHeadersStrip:
+		for _, name := range customHeaderNames() {
+			req.Header.Del(name)
+		}
+		applyHostRules(req, class)
+	default:
+		applyRedirectHeaders(req, class)
+	}
+	return nil
+}
+
+// log prints a redirect. Playlist, key and init redirects are always shown;
+// segment redirects are shown once per host pair.
+func (c *RedirectConfig) log(class RequestClass, from, to *url.URL) {
+	if class == ClassSegment {
+		c.mu.Lock()
+		pair := from.Host + ">" + to.Host
+		seen := c.logged[pair]
+		if c.logged == nil {
+			c.logged = make(map[string]bool)
+		}
+		c.logged[pair] = true
+		c.mu.Unlock()
+		if seen {
+			return
+		}
+		fmt.Printf("\n↪ Segments redirected from %s to %s\n", from.Host, to.Host)
+		return
+	}
+	if class == "" {
+		class = "request"
+	}
+	fmt.Printf("↪ %s redirect: %s -> %s\n", class, from.Redacted(), to.Redacted())
+}
+
+// TransportConfig holds the connection settings applied to httpClient
+type TransportConfig struct {
+	Proxy    *ProxyConfig // nil keeps the proxy environment variables
+	TLS      TLSConfig
+	Redirect *RedirectConfig // nil keeps Go's default redirect handling
+}
+
+// ConfigureTransport installs a transport built from the config on httpClient
+func ConfigureTransport(config TransportConfig) error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.Proxy != nil {
+		transport.Proxy = config.Proxy.proxyFor
+	}
+
+	tlsConfig, err := buildTLSConfig(config.TLS)
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	httpClient.Transport = transport
+	if config.Redirect != nil {
+		httpClient.CheckRedirect = config.Redirect.checkRedirect
+	}
+	return nil
+}